@@ -0,0 +1,85 @@
+-- changes of the jobs table schema, apply in order
+
+-- checkpoint of paused jobs: skip holds the offset to continue from
+ALTER TABLE xmp_jobs ADD COLUMN processed BIGINT NOT NULL DEFAULT 0;
+
+-- what was done on start with the job left "in progress" by the previous run
+ALTER TABLE xmp_jobs ADD COLUMN recovery VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE xmp_jobs ADD COLUMN recovered_at TIMESTAMP WITHOUT TIME ZONE;
+
+-- counters of the actions written in the job log
+CREATE TABLE xmp_job_stats (
+  id_job BIGINT NOT NULL,
+  action VARCHAR(64) NOT NULL,
+  count BIGINT NOT NULL DEFAULT 0,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (id_job, action)
+);
+
+-- recurring jobs: the template creates the job on every run of the schedule
+CREATE TABLE xmp_job_templates (
+  id SERIAL PRIMARY KEY,
+  id_user INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (now() at time zone 'utc'),
+  type VARCHAR(32) NOT NULL,
+  file_name VARCHAR(255) NOT NULL DEFAULT '',
+  params JSONB NOT NULL DEFAULT '{}',
+  schedule VARCHAR(64) NOT NULL,
+  skip BIGINT NOT NULL DEFAULT 0,
+  skip_step BIGINT NOT NULL DEFAULT 0,
+  carry_skip BOOLEAN NOT NULL DEFAULT false,
+  max_fires INT NOT NULL DEFAULT 0,
+  fired INT NOT NULL DEFAULT 0,
+  missed VARCHAR(16) NOT NULL DEFAULT 'run_once',
+  status VARCHAR(16) NOT NULL DEFAULT 'active',
+  next_run_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  last_job_id BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX xmp_job_templates_next_run_at_idx ON xmp_job_templates(status, next_run_at);
+ALTER TABLE xmp_jobs ADD COLUMN id_template INT NOT NULL DEFAULT 0;
+
+-- the instance which has claimed the job and its last heartbeat
+ALTER TABLE xmp_jobs ADD COLUMN owner VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE xmp_jobs ADD COLUMN heartbeat_at TIMESTAMP WITHOUT TIME ZONE;
+CREATE INDEX xmp_jobs_status_heartbeat_at_idx ON xmp_jobs(status, heartbeat_at);
+
+-- charge attempts of the job per day, for params.max_per_day
+CREATE TABLE xmp_job_daily (
+  id_job BIGINT NOT NULL,
+  day VARCHAR(10) NOT NULL,
+  attempts BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (id_job, day)
+);
+
+-- cents reserved per day for jobs.daily_budgets, shared by all instances
+CREATE TABLE xmp_daily_budgets (
+  day VARCHAR(10) NOT NULL,
+  service_code VARCHAR(64) NOT NULL DEFAULT '',
+  operator_code BIGINT NOT NULL DEFAULT 0,
+  spent BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (day, service_code, operator_code)
+);
+
+-- the last charge attempt of the msisdn by any job, for jobs.frequency_cap_hours
+CREATE TABLE xmp_msisdn_attempts (
+  msisdn VARCHAR(32) PRIMARY KEY,
+  last_attempt_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  id_job BIGINT NOT NULL DEFAULT 0
+);
+
+-- the key of the last handled item, the expired jobs are resumed after it
+ALTER TABLE xmp_jobs ADD COLUMN last_key VARCHAR(64) NOT NULL DEFAULT '';
+
+-- uploaded injection files, the checksum rejects the same file uploaded twice
+CREATE TABLE xmp_injection_files (
+  id SERIAL PRIMARY KEY,
+  id_user INT NOT NULL DEFAULT 0,
+  file_name VARCHAR(255) NOT NULL UNIQUE,
+  checksum VARCHAR(64) NOT NULL UNIQUE,
+  size BIGINT NOT NULL DEFAULT 0,
+  preview JSONB NOT NULL DEFAULT '{}',
+  uploaded_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- cents spent by the job until the checkpoint, params.budget continues from it on resume
+ALTER TABLE xmp_jobs ADD COLUMN spent BIGINT NOT NULL DEFAULT 0;
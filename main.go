@@ -11,11 +11,16 @@ import (
 func main() {
 	c := make(chan os.Signal, 3)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	code := make(chan int, 1)
 	go func() {
 		<-c
-		src.OnExit()
-		os.Exit(1)
+		if err := src.OnExit(); err != nil {
+			code <- 1
+			return
+		}
+		code <- 0
 	}()
 
 	src.RunServer()
+	os.Exit(<-code)
 }
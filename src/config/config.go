@@ -15,8 +15,9 @@ import (
 )
 
 type ServerConfig struct {
-	Host string `default:"127.0.0.1" yaml:"host"`
-	Port string `default:"50304" yaml:"port"`
+	Host                   string `default:"127.0.0.1" yaml:"host"`
+	Port                   string `default:"50304" yaml:"port"`
+	ShutdownTimeoutSeconds int    `default:"8" yaml:"shutdown_timeout"` // less than stopwaitsecs in supervisor
 }
 
 type AppConfig struct {
@@ -37,12 +38,79 @@ type MetricsConfig struct {
 }
 
 type JobsConfig struct {
-	PlannedEnabled       bool   `yaml:"planned_enabled"`
-	PlannedPeriodMinutes int    `yaml:"planned_period_minutes"`
-	InjectionsPath       string `yaml:"injections_path" default:"/var/www/xmp.linkit360.ru/web/injections"`
-	LogPath              string `yaml:"log_path" default:"/var/log/"`
-	CheckPrefix          string `yaml:"prefix" default:"92"` // todo: move in settings or in db smth
-	CallBackUrl          string `yaml:"callback_url"`
+	PlannedEnabled             bool   `yaml:"planned_enabled"`
+	PlannedPeriodMinutes       int    `yaml:"planned_period_minutes"` // the scheduler sleeps no longer than this
+	InjectionsPath             string `yaml:"injections_path" default:"/var/www/xmp.linkit360.ru/web/injections"`
+	LogPath                    string `yaml:"log_path" default:"/var/log/"`
+	CheckPrefix                string `yaml:"prefix" default:"92"` // of the default operator when jobs.operators is empty
+	CallBackUrl                string `yaml:"callback_url"`
+	CheckpointPeriodSeconds    int    `yaml:"checkpoint_period_seconds" default:"5"`
+	RecoverResume              bool   `yaml:"recover_resume"`
+	MissedAfterSeconds         int    `yaml:"missed_after_seconds" default:"60"` // the job is missed if it is later than this
+	SchedulerMaxBackoffSeconds int    `yaml:"scheduler_max_backoff_seconds" default:"300"`
+	InstanceId                 string `yaml:"instance_id"` // owner of the claimed jobs, hostname by default
+	HeartbeatSeconds           int    `yaml:"heartbeat_seconds" default:"10"`
+	ClaimStaleSeconds          int    `yaml:"claim_stale_seconds" default:"60"` // the claim without heartbeat is taken by another instance
+	// messages per second, 0 is unlimited
+	RateLimit           float64           `yaml:"rate_limit"`           // of every job, if not set in params
+	GlobalRateLimit     float64           `yaml:"global_rate_limit"`    // of all jobs together
+	OperatorRateLimits  map[int64]float64 `yaml:"operator_rate_limits"` // operator code: of all jobs together
+	RampUpSeconds       int               `yaml:"ramp_up_seconds"`      // the job starts from the tenth of its rate
+	Calendar            CalendarConfig    `yaml:"calendar"`
+	DailyBudgets        []DailyBudget     `yaml:"daily_budgets"`
+	FrequencyCapHours   int               `yaml:"frequency_cap_hours"`                 // one attempt per msisdn across all jobs, 0 is off
+	CheckBatchSize      int               `yaml:"check_batch_size" default:"500"`      // msisdns checked in the slave by one query
+	ExpiredPageSize     int               `yaml:"expired_page_size" default:"1000"`    // retries_expired loaded by one query
+	ListsRefreshSeconds int               `yaml:"lists_refresh_seconds" default:"300"` // blacklist and postpaid reload period
+	// operator code: operator, the jobs charge only the configured operators,
+	// if empty, default_operator is mobilink with prefix and mobilink queues
+	Operators       map[int64]OperatorConfig `yaml:"operators"`
+	DefaultOperator int64                    `yaml:"default_operator" default:"41001"` // of the job without params.operator_code
+	Watch           WatchConfig              `yaml:"watch"`
+}
+
+// WatchConfig is the folders in injections_path the jobs are created from the dropped files
+type WatchConfig struct {
+	Enabled       bool       `yaml:"enabled"`
+	PeriodSeconds int        `yaml:"period_seconds" default:"30"`
+	SettleSeconds int        `yaml:"settle_seconds" default:"10"` // the file not modified for this long is complete
+	Archive       string     `yaml:"archive" default:"archive"`   // subfolder of the watched folder for the processed files
+	Dirs          []WatchDir `yaml:"dirs"`
+}
+
+// WatchDir is the watched folder and the defaults of the jobs without the sidecar .json
+type WatchDir struct {
+	Path            string   `yaml:"path"`              // relative to injections_path, empty is injections_path itself
+	Patterns        []string `yaml:"patterns"`          // *.csv, any file if empty
+	Type            string   `yaml:"type"`              // injection if empty
+	UserId          int64    `yaml:"user_id"`           // of the created jobs
+	Params          string   `yaml:"params"`            // json of the job params
+	RunAfterMinutes int      `yaml:"run_after_minutes"` // run_at is the time the file is picked up plus this
+}
+
+// OperatorConfig is where and how the msisdns of the operator are charged
+type OperatorConfig struct {
+	Name        string   `yaml:"name"`
+	CountryCode int64    `yaml:"country_code"`
+	Prefixes    []string `yaml:"prefixes"`    // the msisdn must start with one of them
+	Requests    string   `yaml:"requests"`    // queue of the charge requests
+	Tarifficate string   `yaml:"tarifficate"` // queue of the suspended subscriptions
+	Timezone    string   `yaml:"timezone"`    // of the send windows and the days of the budgets, calendar.timezone if empty
+}
+
+// DailyBudget is the limit of cents charged per day by all jobs,
+// empty service code or zero operator code means any
+type DailyBudget struct {
+	ServiceCode  string `yaml:"service_code"`
+	OperatorCode int64  `yaml:"operator_code"`
+	Cents        int64  `yaml:"cents"`
+}
+
+// CalendarConfig is when the msisdns could be charged, if the job params don't say otherwise
+type CalendarConfig struct {
+	Timezone  string   `yaml:"timezone" default:"Asia/Karachi"` // of the operator
+	Windows   []string `yaml:"windows"`                         // 09:00-21:00, the whole day if empty
+	Blackouts []string `yaml:"blackouts"`                       // 2017-08-14
 }
 
 func LoadConfig() AppConfig {
@@ -0,0 +1,57 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every 0d",
+		"@every 10s",
+		"@every x",
+	} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	from := time.Date(2017, 8, 31, 10, 30, 0, 0, time.UTC) // thursday
+	for _, c := range []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, 8, 31, 10, 31, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2017, 9, 1, 9, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 8, 31, 11, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2017, 8, 31, 10, 40, 0, 0, time.UTC)},
+		{"0 8-10,14 * * *", time.Date(2017, 8, 31, 14, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2017, 10, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 1", time.Date(2017, 9, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2017, 9, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 12 15 * 5", time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)}, // friday or the 15th
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@every 3d", time.Date(2017, 9, 3, 10, 30, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2017, 8, 31, 12, 0, 0, 0, time.UTC)},
+	} {
+		s, err := Parse(c.spec)
+		if !assert.NoError(t, err, c.spec) {
+			continue
+		}
+		assert.Equal(t, c.next, s.Next(from), c.spec)
+	}
+}
@@ -0,0 +1,165 @@
+package msisdn
+
+// normalization of the msisdns read from the files and the api to the international form
+// without "+", like 923001234567, by the rules of the country:
+// "+92 300-1234567", "0092 300 1234567", "03001234567" and "3001234567" are all 923001234567.
+// the number must be in the mobile range of the country and in the number ranges of the operator
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Reason is why the number was rejected
+type Reason string
+
+const (
+	ReasonEmpty    Reason = "empty"
+	ReasonChars    Reason = "invalid characters"
+	ReasonTooShort Reason = "too short"
+	ReasonTooLong  Reason = "too long"
+	ReasonCountry  Reason = "wrong country"
+	ReasonMobile   Reason = "not mobile"
+	ReasonOperator Reason = "wrong operator"
+)
+
+type Error struct {
+	Reason Reason
+	Orig   string
+}
+
+func (e *Error) Error() string {
+	return string(e.Reason) + ": " + e.Orig
+}
+
+type Rules struct {
+	CountryCode string   // 92
+	Trunk       string   // national prefix: 0
+	Exits       []string // international prefixes: 00
+	Length      int      // digits after the country code, 0 is any from MinLength to MaxLength
+	Mobile      []string // the number after the country code starts with one of them
+	Ranges      []string // of the operator, the msisdn starts with one of them, any if empty
+}
+
+// generic number length bounds when the country has no rules
+const (
+	MinLength = 5
+	MaxLength = 20
+)
+
+// Countries are the rules by the country code
+var Countries = map[string]Rules{
+	"92": {CountryCode: "92", Trunk: "0", Exits: []string{"00"}, Length: 10, Mobile: []string{"3"}},
+	"7":  {CountryCode: "7", Trunk: "8", Exits: []string{"00", "810"}, Length: 10, Mobile: []string{"9"}},
+}
+
+// ForCountry returns the rules of the country, the rules without national forms if it is unknown
+func ForCountry(countryCode string) Rules {
+	if r, ok := Countries[countryCode]; ok {
+		return r
+	}
+	return Rules{CountryCode: countryCode}
+}
+
+// digit is the ascii digit only, the other digits of unicode are rejected
+func digit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func separator(r rune) bool {
+	return r == ' ' || r == '-' || r == '(' || r == ')' || r == '.'
+}
+
+// digits removes the separators, false if there is anything else
+func digits(s string) (string, bool) {
+	b := make([]rune, 0, len(s))
+	for _, r := range s {
+		switch {
+		case digit(r):
+			b = append(b, r)
+		case separator(r):
+		default:
+			return "", false
+		}
+	}
+	return string(b), true
+}
+
+// Normalize returns the msisdn or *Error
+func (rs Rules) Normalize(orig string) (string, error) {
+	reject := func(reason Reason) (string, error) {
+		return "", &Error{Reason: reason, Orig: orig}
+	}
+	// the garbage around the number like quotes and ";" is dropped,
+	// any digit ends the garbage, so the number in non-ascii digits is rejected by digits and not dropped
+	s := strings.TrimFunc(orig, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '+'
+	})
+	if s == "" {
+		return reject(ReasonEmpty)
+	}
+	international := strings.HasPrefix(s, "+")
+	number, ok := digits(strings.TrimPrefix(s, "+"))
+	if !ok {
+		return reject(ReasonChars)
+	}
+
+	nsn, ok := rs.national(number, international)
+	if !ok {
+		return reject(ReasonCountry)
+	}
+	switch {
+	case rs.Length > 0 && len(nsn) < rs.Length:
+		return reject(ReasonTooShort)
+	case rs.Length > 0 && len(nsn) > rs.Length:
+		return reject(ReasonTooLong)
+	case len(rs.CountryCode+nsn) < MinLength:
+		return reject(ReasonTooShort)
+	case len(rs.CountryCode+nsn) > MaxLength:
+		return reject(ReasonTooLong)
+	}
+	if len(rs.Mobile) > 0 && !hasPrefix(nsn, rs.Mobile) {
+		return reject(ReasonMobile)
+	}
+	msisdn := rs.CountryCode + nsn
+	if len(rs.Ranges) > 0 && !hasPrefix(msisdn, rs.Ranges) {
+		return reject(ReasonOperator)
+	}
+	return msisdn, nil
+}
+
+// national returns the number after the country code
+func (rs Rules) national(number string, international bool) (string, bool) {
+	if international {
+		return cut(number, rs.CountryCode)
+	}
+	for _, exit := range rs.Exits {
+		if strings.HasPrefix(number, exit) {
+			return cut(number[len(exit):], rs.CountryCode)
+		}
+	}
+	if rs.Trunk != "" && strings.HasPrefix(number, rs.Trunk) {
+		return number[len(rs.Trunk):], true
+	}
+	// without the country code only if the length says so
+	if rs.Length > 0 && len(number) == rs.Length {
+		return number, true
+	}
+	return cut(number, rs.CountryCode)
+}
+
+func cut(number, prefix string) (string, bool) {
+	if !strings.HasPrefix(number, prefix) {
+		return "", false
+	}
+	return number[len(prefix):], true
+}
+
+func hasPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package msisdn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	pk := ForCountry("92")
+	mobilink := pk
+	mobilink.Ranges = []string{"9230"}
+	ru := ForCountry("7")
+
+	for _, tc := range []struct {
+		rules  Rules
+		orig   string
+		msisdn string
+		reason Reason
+	}{
+		{pk, "923001234567", "923001234567", ""},
+		{pk, "+92 300-1234567", "923001234567", ""},
+		{pk, "0092 300 1234567", "923001234567", ""},
+		{pk, "03001234567", "923001234567", ""},
+		{pk, "3001234567", "923001234567", ""},
+		{pk, "(0300) 123.4567", "923001234567", ""},
+		{pk, "\"923001234567\";", "923001234567", ""},
+		{pk, "", "", ReasonEmpty},
+		{pk, "msisdn", "", ReasonEmpty},
+		{pk, "92300x1234567", "", ReasonChars},
+		{pk, "٠٣٠٠١٢٣٤٥٦٧", "", ReasonChars},
+		{pk, "0300١٢٣٤٥٦٧", "", ReasonChars},
+		{pk, "0300123456", "", ReasonTooShort},
+		{pk, "030012345678", "", ReasonTooLong},
+		{pk, "+79161234567", "", ReasonCountry},
+		{pk, "007 916 1234567", "", ReasonCountry},
+		{pk, "922101234567", "", ReasonMobile},
+		{mobilink, "923001234567", "923001234567", ""},
+		{mobilink, "923451234567", "", ReasonOperator},
+		{ru, "+7 (916) 123-45-67", "79161234567", ""},
+		{ru, "89161234567", "79161234567", ""},
+		{ru, "810 7 916 1234567", "79161234567", ""},
+		{ru, "74951234567", "", ReasonMobile},
+		{ForCountry("44"), "447700900123", "447700900123", ""},
+		{ForCountry("44"), "44770", "44770", ""},
+		{ForCountry("44"), "4477", "", ReasonTooShort},
+		{ForCountry("44"), "447700900123447700900", "", ReasonTooLong},
+	} {
+		msisdn, err := tc.rules.Normalize(tc.orig)
+		if tc.reason == "" {
+			assert.NoError(t, err, tc.orig)
+			assert.Equal(t, tc.msisdn, msisdn, tc.orig)
+			continue
+		}
+		if assert.IsType(t, &Error{}, err, tc.orig) {
+			assert.Equal(t, tc.reason, err.(*Error).Reason, tc.orig)
+		}
+	}
+}
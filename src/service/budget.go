@@ -0,0 +1,268 @@
+package service
+
+// budget caps, the job stops with status budget_exhausted when any of them is reached:
+// - params.budget: cents the job could try to charge in total
+// - params.max_per_day: charge attempts of the job per day
+// - jobs.daily_budgets: cents per day of the service and/or operator, shared by all jobs
+//   and all instances, the spent cents are reserved in daily_budgets table
+// the day is counted in the timezone of the job window: params, operator or calendar
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/rec"
+)
+
+const (
+	statusBudgetExhausted = "budget_exhausted"
+	actionBudget          = "budget exhausted"
+)
+
+// daily is the count of the charge attempts of the job today
+type daily struct {
+	Day      string
+	Attempts int64
+}
+
+// spend counts the attempt of the job if it is within the job budget and daily limit,
+// price is the price of the attempt in cents
+func (r *registry) spend(job *Job, price int64, day string) (ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	p := job.ParsedParams
+	if p.Budget > 0 && job.Spent+price > p.Budget {
+		job.Exhausted = true
+		return false
+	}
+	if job.today.Day != day {
+		job.today = daily{Day: day}
+	}
+	if p.MaxPerDay > 0 && job.today.Attempts >= p.MaxPerDay {
+		job.Exhausted = true
+		return false
+	}
+	job.Spent += price
+	job.today.Attempts++
+	return true
+}
+
+// exhaust stops the job because of the global daily budget
+func (r *registry) exhaust(job *Job) {
+	r.Lock()
+	job.Exhausted = true
+	r.Unlock()
+}
+
+// refund returns the attempt which wasn't sent
+func (r *registry) refund(job *Job, price int64) {
+	r.Lock()
+	defer r.Unlock()
+	job.Spent -= price
+	job.today.Attempts--
+}
+
+// withinBudget is called before the charge request is sent,
+// it returns actionBudget if the job must stop, actionError if the daily budgets can't be reserved
+func (j *Job) withinBudget(r rec.Record) (action string, ok bool) {
+	price := int64(r.Price)
+	day := today(j)
+	if !svc.jobs.registry.spend(j, price, day) {
+		log.WithFields(log.Fields{
+			"id":          j.Id,
+			"spent":       j.Spent,
+			"budget":      j.ParsedParams.Budget,
+			"max_per_day": j.ParsedParams.MaxPerDay,
+		}).Warn("job budget exhausted")
+		return actionBudget, false
+	}
+	reserve := svc.jobs.reserveDaily
+	if j.ParsedParams.DryRun {
+		// the dry run doesn't spend the daily budgets of the real jobs
+		reserve = svc.jobs.checkDaily
+	}
+	err := reserve(day, r.ServiceCode, r.OperatorCode, price)
+	if err == nil {
+		return "", true
+	}
+	svc.jobs.registry.refund(j, price)
+	if err != errDailyBudget {
+		log.WithFields(log.Fields{
+			"id":    j.Id,
+			"error": err.Error(),
+		}).Error("cannt reserve daily budget")
+		return actionError, false
+	}
+	svc.jobs.registry.exhaust(j)
+	log.WithFields(log.Fields{
+		"id":       j.Id,
+		"service":  r.ServiceCode,
+		"operator": r.OperatorCode,
+	}).Warn("daily budget exhausted")
+	return actionBudget, false
+}
+
+// refundBudget returns the budget taken by withinBudget for the charge which wasn't sent
+func (j *Job) refundBudget(r rec.Record) {
+	price := int64(r.Price)
+	svc.jobs.registry.RLock()
+	day := j.today.Day
+	svc.jobs.registry.RUnlock()
+	svc.jobs.registry.refund(j, price)
+	if j.ParsedParams.DryRun {
+		return
+	}
+	for _, b := range svc.jobs.conf.DailyBudgets {
+		if b.ServiceCode != "" && b.ServiceCode != r.ServiceCode {
+			continue
+		}
+		if b.OperatorCode != 0 && b.OperatorCode != r.OperatorCode {
+			continue
+		}
+		if err := svc.jobs.addDaily(day, b.ServiceCode, b.OperatorCode, -price); err != nil {
+			log.WithFields(log.Fields{
+				"id":    j.Id,
+				"error": err.Error(),
+			}).Error("cannt refund daily budget")
+		}
+	}
+}
+
+// dayLocation is the timezone the day of the job is counted in
+func dayLocation(job *Job) *time.Location {
+	if job.window != nil {
+		return job.window.loc
+	}
+	return time.UTC
+}
+
+func today(job *Job) string {
+	return time.Now().In(dayLocation(job)).Format("2006-01-02")
+}
+
+var errDailyBudget = errors.New("Daily budget exhausted")
+
+// reserveDaily reserves the cents in every daily budget the charge falls under,
+// if one of them is exhausted the reserved ones are returned back
+func (j *jobs) reserveDaily(day, serviceCode string, operatorCode, price int64) (err error) {
+	reserved := []int{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, i := range reserved {
+			b := j.conf.DailyBudgets[i]
+			if refundErr := j.addDaily(day, b.ServiceCode, b.OperatorCode, -price); refundErr != nil {
+				log.WithFields(log.Fields{
+					"error": refundErr.Error(),
+				}).Error("cannt refund daily budget")
+			}
+		}
+	}()
+
+	for i, b := range j.conf.DailyBudgets {
+		if b.ServiceCode != "" && b.ServiceCode != serviceCode {
+			continue
+		}
+		if b.OperatorCode != 0 && b.OperatorCode != operatorCode {
+			continue
+		}
+		if price > b.Cents {
+			return errDailyBudget
+		}
+		query := fmt.Sprintf("INSERT INTO %sdaily_budgets AS b (day, service_code, operator_code, spent) "+
+			" VALUES ($1, $2, $3, $4) "+
+			" ON CONFLICT (day, service_code, operator_code) DO UPDATE SET spent = b.spent + EXCLUDED.spent "+
+			" WHERE b.spent + EXCLUDED.spent <= $5 RETURNING spent",
+			svc.conf.db.TablePrefix,
+		)
+		var spent int64
+		if err = svc.dbConn.QueryRow(query, day, b.ServiceCode, b.OperatorCode, price, b.Cents).Scan(&spent); err != nil {
+			if err == sql.ErrNoRows {
+				return errDailyBudget
+			}
+			DBErrors.Inc()
+			err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+			return
+		}
+		reserved = append(reserved, i)
+	}
+	return nil
+}
+
+// checkDaily tells if the cents fit in every daily budget the charge falls under, nothing is reserved
+func (j *jobs) checkDaily(day, serviceCode string, operatorCode, price int64) (err error) {
+	for _, b := range j.conf.DailyBudgets {
+		if b.ServiceCode != "" && b.ServiceCode != serviceCode {
+			continue
+		}
+		if b.OperatorCode != 0 && b.OperatorCode != operatorCode {
+			continue
+		}
+		query := fmt.Sprintf("SELECT spent FROM %sdaily_budgets "+
+			" WHERE day = $1 AND service_code = $2 AND operator_code = $3",
+			svc.conf.db.TablePrefix,
+		)
+		var spent int64
+		if err = svc.dbConn.QueryRow(query, day, b.ServiceCode, b.OperatorCode).Scan(&spent); err != nil && err != sql.ErrNoRows {
+			DBErrors.Inc()
+			err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+			return
+		}
+		if spent+price > b.Cents {
+			return errDailyBudget
+		}
+	}
+	return nil
+}
+
+func (j *jobs) addDaily(day, serviceCode string, operatorCode, cents int64) (err error) {
+	query := fmt.Sprintf("UPDATE %sdaily_budgets SET spent = spent + $1 "+
+		" WHERE day = $2 AND service_code = $3 AND operator_code = $4",
+		svc.conf.db.TablePrefix,
+	)
+	if _, err = svc.dbConn.Exec(query, cents, day, serviceCode, operatorCode); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+func (j *jobs) setDaily(id int64, d daily) (err error) {
+	if d.Day == "" {
+		return
+	}
+	query := fmt.Sprintf("INSERT INTO %sjob_daily (id_job, day, attempts) VALUES ($1, $2, $3) "+
+		" ON CONFLICT (id_job, day) DO UPDATE SET attempts = EXCLUDED.attempts",
+		svc.conf.db.TablePrefix,
+	)
+	if _, err = svc.dbConn.Exec(query, id, d.Day, d.Attempts); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+// getDaily returns the attempts of the job on the day, zero if there were none
+func (j *jobs) getDaily(id int64, day string) (d daily, err error) {
+	d.Day = day
+	query := fmt.Sprintf("SELECT attempts FROM %sjob_daily WHERE id_job = $1 AND day = $2",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query, id, day).Scan(&d.Attempts); err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+			return
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
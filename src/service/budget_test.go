@@ -0,0 +1,70 @@
+package service
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+	"github.com/linkit360/go-utils/rec"
+)
+
+func TestRegistrySpend(t *testing.T) {
+	r := newRegistry()
+	job := &Job{Id: 1, ParsedParams: Params{Budget: 250, MaxPerDay: 2}}
+	assert.NoError(t, r.add(job), "add")
+
+	assert.True(t, r.spend(job, 100, "2017-08-14"), "first")
+	assert.True(t, r.spend(job, 100, "2017-08-14"), "second")
+	assert.False(t, r.spend(job, 10, "2017-08-14"), "max per day")
+	requested, status := r.stopRequested(job)
+	assert.True(t, requested, "exhausted job stops")
+	assert.Equal(t, statusBudgetExhausted, status)
+
+	job.Exhausted = false
+	assert.True(t, r.spend(job, 40, "2017-08-15"), "next day")
+	assert.Equal(t, int64(1), job.today.Attempts, "attempts of the new day")
+	assert.False(t, r.spend(job, 100, "2017-08-15"), "budget")
+	assert.Equal(t, int64(240), job.Spent, "not spent over budget")
+
+	r.refund(job, 40)
+	assert.Equal(t, int64(200), job.Spent, "refund")
+	assert.Equal(t, int64(0), job.today.Attempts, "refund attempt")
+}
+
+func TestExpiredBudget(t *testing.T) {
+	saved := svc.jobs
+	defer func() { svc.jobs = saved }()
+	conf := config.JobsConfig{Operators: map[int64]config.OperatorConfig{
+		41001: {CountryCode: 92, Prefixes: []string{"92"}, Requests: "mobilink_requests"},
+	}}
+	svc.jobs = &jobs{
+		registry: newRegistry(),
+		limits:   newLimits(conf),
+		lists:    newMsisdnLists(),
+		conf:     conf,
+	}
+	svc.jobs.lists.loaded = true
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	job := &Job{Id: 1, ParsedParams: Params{Budget: 250, DryRun: true}, log: logger, limiter: newJobLimiter()}
+	assert.NoError(t, svc.jobs.registry.add(job), "add")
+
+	e := &expired{}
+	for i, msisdn := range []string{"923001112233", "923004445566", "923007778899"} {
+		e.Process(job, Item{Idx: int64(i), Msisdn: msisdn, Key: msisdn, Record: rec.Record{
+			Msisdn:       msisdn,
+			OperatorCode: 41001,
+			Price:        100,
+		}})
+	}
+	assert.Equal(t, int64(200), job.Spent, "the price of the retries")
+	assert.Equal(t, int64(2), job.Stats[actionSent])
+	assert.Equal(t, int64(1), job.Stats[actionBudget])
+	requested, status := svc.jobs.registry.stopRequested(job)
+	assert.True(t, requested, "exhausted job stops")
+	assert.Equal(t, statusBudgetExhausted, status)
+}
@@ -0,0 +1,226 @@
+package service
+
+// several instances could run with planned_enabled on the same jobs table.
+// the job is started only by the instance which has claimed it:
+// status is changed to "in progress" with the owner in one update guarded by the status.
+// the owner updates heartbeat_at of its running jobs, the claims with old heartbeat
+// are taken by any live instance and recovered as the orphaned jobs.
+// the status and the checkpoint of the running job are written by its owner only
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errJobClaimed = errors.New("Job is claimed by another instance")
+
+// statusLost is the exit status of the job which claim was taken by another instance,
+// nothing is saved for it, the job belongs to the new owner
+const statusLost = "lost"
+
+func instanceId(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("os.Hostname")
+		return fmt.Sprintf("pid-%d", os.Getpid())
+	}
+	return host
+}
+
+// claim sets the job "in progress" if its status is one of from
+func (j *jobs) claim(id int64, from ...string) (err error) {
+	args := []interface{}{j.conf.InstanceId, time.Now().UTC(), id}
+	in := []string{}
+	for _, status := range from {
+		args = append(args, status)
+		in = append(in, fmt.Sprintf("$%d", len(args)))
+	}
+	query := fmt.Sprintf("UPDATE %sjobs SET status = 'in progress', owner = $1, heartbeat_at = $2 "+
+		" WHERE id = $3 AND status IN ("+strings.Join(in, ", ")+") RETURNING id",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query, args...).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return errJobClaimed
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	j.callback(id, "in progress")
+	return
+}
+
+// unclaim gives back the claimed job which couldn't be started, with the status it had
+func (j *jobs) unclaim(id int64, status string) {
+	if err := j.setStatus(id, status); err != nil {
+		log.WithFields(log.Fields{
+			"id":     id,
+			"status": status,
+			"error":  err.Error(),
+		}).Error("cannt unclaim")
+	}
+}
+
+// heartbeats keeps the claims of the running jobs alive and takes the stale ones
+func (j *jobs) heartbeats() {
+	for range time.Tick(time.Duration(j.conf.HeartbeatSeconds) * time.Second) {
+		for _, job := range j.registry.snapshot() {
+			if job.finished {
+				continue
+			}
+			err := j.heartbeat(job.Id)
+			if err == errJobClaimed {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"owner": j.conf.InstanceId,
+				}).Error("claim lost, stopping")
+				j.registry.loseClaim(job.Id)
+				continue
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("heartbeat")
+			}
+		}
+		j.reclaimStale(false)
+	}
+}
+
+func (j *jobs) heartbeat(id int64) (err error) {
+	query := fmt.Sprintf("UPDATE %sjobs SET heartbeat_at = $1 "+
+		" WHERE id = $2 AND owner = $3 AND status IN ('in progress', 'waiting for window')",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := svc.dbConn.Exec(query, time.Now().UTC(), id, j.conf.InstanceId)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errJobClaimed
+	}
+	return
+}
+
+// reclaimStale recovers the jobs "in progress" or waiting for window which owner doesn't send heartbeats,
+// own jobs are orphaned only on start, when nothing is running yet
+func (j *jobs) reclaimStale(own bool) {
+	staleBefore := time.Now().UTC().Add(-time.Duration(j.conf.ClaimStaleSeconds) * time.Second)
+	orphaned, err := j.getStaleClaims(staleBefore, own)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannot recover jobs")
+		return
+	}
+
+	for _, job := range orphaned {
+		if _, ok := j.registry.get(job.Id); ok {
+			continue // running here, the heartbeat is just late
+		}
+		if err := j.takeClaim(job, staleBefore); err != nil {
+			if err != errJobClaimed {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("take claim")
+			}
+			continue
+		}
+
+		action := "interrupted"
+		if job.Processed == 0 {
+			action = "requeued"
+		} else if j.conf.RecoverResume {
+			action = "resumed"
+		}
+		if err := j.recoverJob(job, action); err != nil {
+			log.WithFields(log.Fields{
+				"id":     job.Id,
+				"action": action,
+				"error":  err.Error(),
+			}).Error("recover failed")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":        job.Id,
+			"type":      job.Type,
+			"skip":      job.Skip,
+			"processed": job.Processed,
+			"owner":     job.Owner,
+			"action":    action,
+		}).Info("recovered")
+	}
+}
+
+func (j *jobs) getStaleClaims(staleBefore time.Time, own bool) (jobs []Job, err error) {
+	query := fmt.Sprintf("SELECT id, type, skip, processed, owner "+
+		" FROM %sjobs WHERE status IN ('in progress', 'waiting for window') AND "+
+		" ((heartbeat_at IS NULL OR heartbeat_at < $1) OR (owner = $2 AND $3)) "+
+		" ORDER BY id",
+		svc.conf.db.TablePrefix,
+	)
+	var rows *sql.Rows
+	rows, err = svc.dbConn.Query(query, staleBefore, j.conf.InstanceId, own)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job Job
+		if err = rows.Scan(&job.Id, &job.Type, &job.Skip, &job.Processed, &job.Owner); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	return
+}
+
+// takeClaim makes this instance the owner of the stale job, only one instance succeeds
+func (j *jobs) takeClaim(job Job, staleBefore time.Time) (err error) {
+	query := fmt.Sprintf("UPDATE %sjobs SET owner = $1, heartbeat_at = $2 "+
+		" WHERE id = $3 AND status IN ('in progress', 'waiting for window') AND owner = $4 AND "+
+		" (heartbeat_at IS NULL OR heartbeat_at < $5 OR owner = $1) RETURNING id",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query,
+		j.conf.InstanceId,
+		time.Now().UTC(),
+		job.Id,
+		job.Owner,
+		staleBefore,
+	).Scan(&job.Id); err != nil {
+		if err == sql.ErrNoRows {
+			return errJobClaimed
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package service
+
+// eligibility of the msisdns is checked in the slave by batches of jobs.check_batch_size,
+// one query per batch instead of one per msisdn
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// pgArray makes postgres array literal from the msisdns, they are digits only
+func pgArray(msisdns []string) string {
+	return "{" + strings.Join(msisdns, ",") + "}"
+}
+
+// paidMsisdns returns the msisdns of the batch which must not be charged:
+// paid after params.last_charge_at, or paid ever if params.never is set
+func (j *jobs) paidMsisdns(p Params, msisdns []string) (paid map[string]struct{}, err error) {
+	paid = make(map[string]struct{})
+	if len(msisdns) == 0 {
+		return
+	}
+	if p.LastChargeAt != "" {
+		query := fmt.Sprintf("SELECT DISTINCT msisdn FROM %stransactions "+
+			" WHERE ( result = 'paid' OR result = 'retry_paid') AND "+
+			" sent_at > $1 AND msisdn = ANY($2::varchar[])",
+			svc.conf.db.TablePrefix,
+		)
+		if err = j.collectMsisdns(paid, query, p.LastChargeAt, pgArray(msisdns)); err != nil {
+			return
+		}
+	}
+	if p.Never > 0 {
+		query := fmt.Sprintf("SELECT DISTINCT msisdn FROM %stransactions "+
+			" WHERE ( result = 'paid' OR result = 'retry_paid' OR result = 'injection_paid' OR result = 'expired_paid') AND "+
+			" msisdn = ANY($1::varchar[])",
+			svc.conf.db.TablePrefix,
+		)
+		if err = j.collectMsisdns(paid, query, pgArray(msisdns)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (j *jobs) collectMsisdns(set map[string]struct{}, query string, args ...interface{}) (err error) {
+	var rows *sql.Rows
+	if rows, err = j.slave.Query(query, args...); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("slave.Query: %s, query %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msisdn string
+		if err = rows.Scan(&msisdn); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		set[msisdn] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package service
+
+// the query of the expired job is built from params by queryBuilder:
+// every value goes as an arg, the sort field and the order are taken from the whitelists
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// queryBuilder collects the where clauses, "?" in the clause is replaced by the next $n
+type queryBuilder struct {
+	wheres []string
+	args   []interface{}
+}
+
+func (b *queryBuilder) where(clause string, args ...interface{}) {
+	for _, arg := range args {
+		b.args = append(b.args, arg)
+		clause = strings.Replace(clause, "?", "$"+strconv.Itoa(len(b.args)), 1)
+	}
+	b.wheres = append(b.wheres, clause)
+}
+
+func (b *queryBuilder) sql() string {
+	if len(b.wheres) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(b.wheres, " AND ")
+}
+
+// expiredSorts is the column the retry of the msisdn is chosen by, params.sort
+var expiredSorts = map[string]string{
+	"":                    "id",
+	"id":                  "id",
+	"created_at":          "created_at",
+	"last_pay_attempt_at": "last_pay_attempt_at",
+	"attempts_count":      "attempts_count",
+}
+
+var expiredOrders = map[string]string{
+	"":     "ASC",
+	"asc":  "ASC",
+	"desc": "DESC",
+}
+
+func int64sArray(ids []int64) string {
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s = append(s, strconv.FormatInt(id, 10))
+	}
+	return pgArray(s)
+}
+
+// expiredQuery returns the query of the page of retries with msisdn greater than after,
+// limit 0 is unlimited
+func expiredQuery(p Params, after string, limit int) (query string, args []interface{}, err error) {
+	sort, ok := expiredSorts[strings.ToLower(p.Sort)]
+	if !ok {
+		return "", nil, fmt.Errorf("sort must be id, created_at, last_pay_attempt_at or attempts_count: %s", p.Sort)
+	}
+	order, ok := expiredOrders[strings.ToLower(p.Order)]
+	if !ok {
+		return "", nil, fmt.Errorf("order must be asc or desc: %s", p.Order)
+	}
+	if p.AttemptsFrom > 0 && p.AttemptsTo > 0 && p.AttemptsFrom > p.AttemptsTo {
+		return "", nil, fmt.Errorf("attempts_from is greater than attempts_to: %d > %d", p.AttemptsFrom, p.AttemptsTo)
+	}
+
+	b := &queryBuilder{}
+	if p.DateFrom != "" {
+		b.where("created_at > ?", p.DateFrom)
+	}
+	if p.DateTo != "" {
+		b.where("created_at < ?", p.DateTo)
+	}
+	if p.ServiceCode != "" {
+		b.where("id_service = ?", p.ServiceCode)
+	}
+	if p.CampaignId != "" {
+		b.where("id_campaign = ?", p.CampaignId)
+	}
+	if p.OperatorCode > 0 {
+		b.where("operator_code = ?", p.OperatorCode)
+	}
+	if p.AttemptsFrom > 0 {
+		b.where("attempts_count >= ?", p.AttemptsFrom)
+	}
+	if p.AttemptsTo > 0 {
+		b.where("attempts_count <= ?", p.AttemptsTo)
+	}
+	if p.LastPayAttemptFrom != "" {
+		b.where("last_pay_attempt_at > ?", p.LastPayAttemptFrom)
+	}
+	if p.LastPayAttemptTo != "" {
+		b.where("last_pay_attempt_at < ?", p.LastPayAttemptTo)
+	}
+	if len(p.SubscriptionIds) > 0 {
+		b.where("id_subscription = ANY(?::bigint[])", int64sArray(p.SubscriptionIds))
+	}
+	if p.Never > 0 {
+		b.where(fmt.Sprintf("msisdn NOT IN ("+
+			" SELECT DISTINCT msisdn "+
+			" FROM %stransactions "+
+			" WHERE ( result = 'paid' OR result = 'retry_paid' OR result = 'injection_paid' OR result = 'expired_paid') )",
+			svc.conf.db.TablePrefix,
+		))
+	}
+	if p.LastChargeAt != "" {
+		b.where(fmt.Sprintf("msisdn NOT IN ("+
+			" SELECT DISTINCT msisdn "+
+			" FROM %stransactions "+
+			" WHERE ( result = 'paid' OR result = 'retry_paid') AND sent_at > ? )",
+			svc.conf.db.TablePrefix,
+		), p.LastChargeAt)
+	}
+	if after != "" {
+		b.where("msisdn > ?", after)
+	}
+
+	query = fmt.Sprintf("SELECT "+
+		"DISTINCT ON (msisdn) msisdn, "+
+		"id, "+
+		"tid, "+
+		"created_at, "+
+		"last_pay_attempt_at, "+
+		"attempts_count, "+
+		"retry_days, "+
+		"delay_hours, "+
+		"price, "+
+		"operator_code, "+
+		"country_code, "+
+		"id_service, "+
+		"id_subscription, "+
+		"id_campaign "+
+		"FROM %sretries_expired"+
+		b.sql()+
+		" ORDER BY msisdn, %s %s",
+		svc.conf.db.TablePrefix, sort, order,
+	)
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return query, b.args, nil
+}
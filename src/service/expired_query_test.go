@@ -0,0 +1,58 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiredQueryArgs(t *testing.T) {
+	query, args, err := expiredQuery(Params{
+		DateFrom:     "2017-08-01",
+		Never:        1,
+		LastChargeAt: "2017-08-10",
+		OperatorCode: 41001,
+	}, "923001112233", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"2017-08-01", int64(41001), "2017-08-10", "923001112233"}, args)
+	assert.Contains(t, query, "created_at > $1")
+	assert.Contains(t, query, "operator_code = $2")
+	assert.Contains(t, query, "sent_at > $3", "never has no arg, the numbering goes on")
+	assert.Contains(t, query, "msisdn > $4")
+	assert.True(t, strings.HasSuffix(query, " ORDER BY msisdn, id ASC LIMIT 100"), query)
+}
+
+func TestExpiredQueryFilters(t *testing.T) {
+	query, args, err := expiredQuery(Params{
+		AttemptsFrom:       2,
+		AttemptsTo:         5,
+		LastPayAttemptFrom: "2017-08-01",
+		LastPayAttemptTo:   "2017-08-02",
+		SubscriptionIds:    []int64{10, 20},
+		Sort:               "last_pay_attempt_at",
+		Order:              "DESC",
+	}, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{2, 5, "2017-08-01", "2017-08-02", "{10,20}"}, args)
+	assert.Contains(t, query, "attempts_count >= $1 AND attempts_count <= $2")
+	assert.Contains(t, query, "last_pay_attempt_at > $3 AND last_pay_attempt_at < $4")
+	assert.Contains(t, query, "id_subscription = ANY($5::bigint[])")
+	assert.True(t, strings.HasSuffix(query, " ORDER BY msisdn, last_pay_attempt_at DESC"), query)
+}
+
+func TestExpiredQueryWhitelist(t *testing.T) {
+	_, _, err := expiredQuery(Params{Order: "asc; DROP TABLE xmp_jobs"}, "", 0)
+	assert.Error(t, err, "order")
+
+	_, _, err = expiredQuery(Params{Sort: "price desc, id"}, "", 0)
+	assert.Error(t, err, "sort")
+
+	_, _, err = expiredQuery(Params{AttemptsFrom: 5, AttemptsTo: 2}, "", 0)
+	assert.Error(t, err, "attempts range")
+
+	query, args, err := expiredQuery(Params{}, "", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+	assert.NotContains(t, query, "WHERE")
+}
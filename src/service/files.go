@@ -0,0 +1,324 @@
+package service
+
+// injection files uploaded by POST /files are stored in injections_path,
+// the file is registered in injection_files table with its sha256 checksum,
+// the same content can't be uploaded twice.
+// the preview is the dry read of the file by the injection reader, it is made in background
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/msisdn"
+)
+
+var (
+	errFileNotFound = errors.New("File not found")
+	errFileExists   = errors.New("File already uploaded")
+	errFileInUse    = errors.New("File is used by the job")
+)
+
+type InjectionFile struct {
+	Id         int64     `json:"id"`
+	UserId     int64     `json:"user_id"`
+	FileName   string    `json:"file_name"`
+	Checksum   string    `json:"checksum"` // sha256
+	Size       int64     `json:"size"`
+	Preview    Preview   `json:"preview"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+const (
+	previewPending = "pending"
+	previewDone    = "done"
+	previewFailed  = "failed"
+)
+
+// Preview is what the injection job would do with the file
+type Preview struct {
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"` // why it is failed
+	Lines      int64            `json:"lines"`
+	Valid      int64            `json:"valid"`   // would be charged
+	Invalid    map[string]int64 `json:"invalid"` // by reason
+	Duplicates int64            `json:"duplicates"`
+	Paid       *int64           `json:"paid,omitempty"` // if last_charge_at or never is given
+	// the params of the upload, the pending preview is made with them after the restart
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// preview reads the file the same way as the injection job with the params
+func (j *jobs) preview(path string, p Params) (pr Preview, err error) {
+	_, o, err := j.jobOperator(p)
+	if err != nil {
+		return
+	}
+	fh, err := openInput(path)
+	if err != nil {
+		return
+	}
+	in := &injection{
+		rules:   operatorRules(o),
+		fh:      fh,
+		scanner: bufio.NewScanner(fh),
+		chunks:  make(chan chunk, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go in.readChunks(0, 0, false, p)
+	defer in.Finalize(&Job{})
+
+	pr.Invalid = make(map[string]int64)
+	if p.LastChargeAt != "" || p.Never > 0 {
+		pr.Paid = new(int64)
+	}
+	seen := make(map[string]struct{})
+	for c := range in.chunks {
+		if c.err != nil {
+			return pr, c.err
+		}
+		for _, item := range c.items {
+			pr.Lines++
+			switch e := item.Err.(type) {
+			case nil:
+			case *msisdn.Error:
+				pr.Invalid[string(e.Reason)]++
+				continue
+			case errInvalidRow:
+				pr.Invalid[actionInvalidRow]++
+				continue
+			default:
+				if item.Err == errPaidInTransactions {
+					*pr.Paid++
+				} else {
+					pr.Invalid[item.Err.Error()]++
+				}
+				continue
+			}
+			key := dedupKey(item)
+			if _, ok := seen[key]; ok {
+				pr.Duplicates++
+				continue
+			}
+			seen[key] = struct{}{}
+			pr.Valid++
+		}
+	}
+	return
+}
+
+// previewFile makes the preview of the uploaded file and saves it
+func (j *jobs) previewFile(id int64, path string, params json.RawMessage, p Params) {
+	pr, err := j.preview(path, p)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"file":  path,
+			"error": err.Error(),
+		}).Error("preview")
+		pr = Preview{Status: previewFailed, Error: err.Error()}
+	} else {
+		pr.Status = previewDone
+		log.WithFields(log.Fields{
+			"id":    id,
+			"lines": pr.Lines,
+			"valid": pr.Valid,
+		}).Info("preview")
+	}
+	pr.Params = params
+	if err := j.setPreview(id, pr); err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("set preview")
+	}
+}
+
+// resumePreviews makes the previews which weren't done before the restart, with the params of the upload
+func (j *jobs) resumePreviews() {
+	files, err := j.getFiles("WHERE preview->>'status' = $1", []interface{}{previewPending}, 0, 0)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannt get pending previews")
+		return
+	}
+	for _, f := range files {
+		p, err := previewParams(f.FileName, string(f.Preview.Params))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":    f.Id,
+				"error": err.Error(),
+			}).Error("preview")
+			if err := j.setPreview(f.Id, Preview{Status: previewFailed, Error: err.Error(), Params: f.Preview.Params}); err != nil {
+				log.WithFields(log.Fields{
+					"id":    f.Id,
+					"error": err.Error(),
+				}).Error("set preview")
+			}
+			continue
+		}
+		go j.previewFile(f.Id, j.conf.InjectionsPath+"/"+f.FileName, f.Preview.Params, p)
+	}
+}
+
+const fileFields = "id, id_user, file_name, checksum, size, preview, uploaded_at"
+
+func scanFile(rows *sql.Rows) (f InjectionFile, err error) {
+	var preview string
+	if err = rows.Scan(
+		&f.Id,
+		&f.UserId,
+		&f.FileName,
+		&f.Checksum,
+		&f.Size,
+		&preview,
+		&f.UploadedAt,
+	); err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(preview), &f.Preview); err != nil {
+		err = fmt.Errorf("json.Unmarshal: %s, preview: %s", err.Error(), preview)
+	}
+	return
+}
+
+func (j *jobs) getFiles(where string, args []interface{}, limit, offset int) (files []InjectionFile, err error) {
+	query := fmt.Sprintf("SELECT "+fileFields+
+		" FROM %sinjection_files "+
+		where+
+		" ORDER BY id DESC",
+		svc.conf.db.TablePrefix,
+	)
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	}
+	var rows *sql.Rows
+	rows, err = svc.dbConn.Query(query, args...)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	files = []InjectionFile{}
+	for rows.Next() {
+		var f InjectionFile
+		if f, err = scanFile(rows); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		files = append(files, f)
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	return
+}
+
+func (j *jobs) getFile(id int64) (f InjectionFile, err error) {
+	files, err := j.getFiles("WHERE id = $1", []interface{}{id}, 1, 0)
+	if err != nil {
+		return
+	}
+	if len(files) == 0 {
+		return f, errFileNotFound
+	}
+	return files[0], nil
+}
+
+// fileUploaded returns the file with the same name or the same content
+func (j *jobs) fileUploaded(fileName, checksum string) (f InjectionFile, ok bool, err error) {
+	files, err := j.getFiles("WHERE file_name = $1 OR checksum = $2", []interface{}{fileName, checksum}, 1, 0)
+	if err != nil || len(files) == 0 {
+		return
+	}
+	return files[0], true, nil
+}
+
+// insertFile registers the file before it is moved to injections_path,
+// the unique file name and checksum keep the concurrent uploads out
+func (j *jobs) insertFile(f InjectionFile) (id int64, err error) {
+	preview, err := json.Marshal(f.Preview)
+	if err != nil {
+		return 0, fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	query := fmt.Sprintf("INSERT INTO %sinjection_files (id_user, file_name, checksum, size, preview) "+
+		" VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query, f.UserId, f.FileName, f.Checksum, f.Size, string(preview)).Scan(&id); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+func (j *jobs) setPreview(id int64, pr Preview) (err error) {
+	preview, err := json.Marshal(pr)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	query := fmt.Sprintf("UPDATE %sinjection_files SET preview = $1 WHERE id = $2", svc.conf.db.TablePrefix)
+	if _, err = svc.dbConn.Exec(query, string(preview), id); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+func (j *jobs) deleteFile(id int64) (err error) {
+	query := fmt.Sprintf("DELETE FROM %sinjection_files WHERE id = $1", svc.conf.db.TablePrefix)
+	if _, err = svc.dbConn.Exec(query, id); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+// fileInUse tells if the job which isn't finished yet reads the file
+func (j *jobs) fileInUse(fileName string) (inUse bool, err error) {
+	args := []interface{}{fileName}
+	placeholders := []string{}
+	for _, status := range unfinishedStatuses {
+		args = append(args, status)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	query := fmt.Sprintf("SELECT 1 FROM %sjobs WHERE file_name = $1 AND status IN ("+
+		strings.Join(placeholders, ", ")+") LIMIT 1",
+		svc.conf.db.TablePrefix,
+	)
+	var one int
+	if err = svc.dbConn.QueryRow(query, args...).Scan(&one); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return true, nil
+}
+
+// removeUpload removes the file from injections_path, it may be not there already
+func removeUpload(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.Remove: %s", err.Error())
+	}
+	return nil
+}
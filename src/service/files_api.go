@@ -0,0 +1,293 @@
+package service
+
+// rest api for the injection files:
+// POST /files multipart with "file", optional "user_id" and "params" of the injection job for the preview,
+// the preview is made in background, its status is pending until then,
+// GET /files, GET and DELETE /files/:id, the file used by the job which isn't finished can't be deleted
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// previewParams are the params of the injection job the preview is made with,
+// they are checked the same way as the params of the job which would read the file
+func previewParams(fileName, s string) (p Params, err error) {
+	if s == "" {
+		return
+	}
+	job := Job{Type: "injection", FileName: fileName, Params: s}
+	if err = job.validate(); err != nil {
+		return
+	}
+	return job.ParsedParams, nil
+}
+
+func (j *jobs) uploadFile(c *gin.Context) {
+	src, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("file: %s", err.Error()),
+		})
+		return
+	}
+	defer src.Close()
+
+	f := InjectionFile{FileName: filepath.Base(header.Filename)}
+	if f.FileName == "." || f.FileName == "/" || strings.HasPrefix(f.FileName, ".") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("wrong file name: %s", header.Filename),
+		})
+		return
+	}
+	if v := c.PostForm("user_id"); v != "" {
+		if f.UserId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("user_id: %s", err.Error()),
+			})
+			return
+		}
+	}
+	// the upload is written next to the files, so it is moved in place by rename,
+	// it keeps the extension, so it is read the same way when the params are validated
+	tmp, err := ioutil.TempFile(j.conf.InjectionsPath, ".upload-*"+filepath.Ext(f.FileName))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("ioutil.TempFile: %s", err.Error()),
+		})
+		return
+	}
+	defer removeUpload(tmp.Name())
+	hash := sha256.New()
+	f.Size, err = io.Copy(io.MultiWriter(tmp, hash), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("save upload: %s", err.Error()),
+		})
+		return
+	}
+	f.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	// the wrong params leave nothing behind
+	params := c.PostForm("params")
+	p, err := previewParams(filepath.Base(tmp.Name()), params)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	f.Preview = Preview{Status: previewPending}
+	if params != "" {
+		f.Preview.Params = json.RawMessage(params)
+	}
+
+	path := j.conf.InjectionsPath + "/" + f.FileName
+	if !j.registerUpload(c, &f, path) {
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		j.rejectUpload(c, f, path, http.StatusInternalServerError, fmt.Errorf("os.Rename: %s", err.Error()))
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":       f.Id,
+		"file":     f.FileName,
+		"size":     f.Size,
+		"checksum": f.Checksum,
+	}).Info("file uploaded")
+	// the big file is read for minutes, GET /files/:id shows the preview when it is done
+	go j.previewFile(f.Id, path, f.Preview.Params, p)
+	j.respondFile(c, http.StatusCreated, f.Id)
+}
+
+// registerUpload inserts the file unless the same name or content is uploaded already
+func (j *jobs) registerUpload(c *gin.Context, f *InjectionFile, path string) bool {
+	conflict := func(existing InjectionFile) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": errFileExists.Error(),
+			"file":  existing,
+		})
+	}
+	existing, ok, err := j.fileUploaded(f.FileName, f.Checksum)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return false
+	}
+	if ok {
+		conflict(existing)
+		return false
+	}
+	// the file copied by hand isn't replaced
+	if _, err := os.Stat(path); err == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("%s: %s", errFileExists.Error(), f.FileName),
+		})
+		return false
+	}
+	if f.Id, err = j.insertFile(*f); err != nil {
+		// the same file could be uploaded at the same time
+		if existing, ok, _ := j.fileUploaded(f.FileName, f.Checksum); ok {
+			conflict(existing)
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// rejectUpload removes the registered file which can't be used
+func (j *jobs) rejectUpload(c *gin.Context, f InjectionFile, path string, code int, err error) {
+	log.WithFields(log.Fields{
+		"id":    f.Id,
+		"file":  f.FileName,
+		"error": err.Error(),
+	}).Error("upload rejected")
+	if removeErr := removeUpload(path); removeErr != nil {
+		log.WithFields(log.Fields{
+			"file":  f.FileName,
+			"error": removeErr.Error(),
+		}).Error("remove upload")
+	}
+	if deleteErr := j.deleteFile(f.Id); deleteErr != nil {
+		log.WithFields(log.Fields{
+			"id":    f.Id,
+			"error": deleteErr.Error(),
+		}).Error("delete file")
+	}
+	c.JSON(code, gin.H{
+		"error": err.Error(),
+	})
+}
+
+func (j *jobs) respondFile(c *gin.Context, code int, id int64) {
+	f, err := j.getFile(id)
+	if err == errFileNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(code, f)
+}
+
+func (j *jobs) readFile(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	j.respondFile(c, http.StatusOK, id)
+}
+
+// listFiles?limit=100&offset=0
+func (j *jobs) listFiles(c *gin.Context) {
+	limit, offset := 100, 0
+	var err error
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be from 1 to 1000",
+			})
+			return
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "offset must be positive",
+			})
+			return
+		}
+	}
+
+	files, err := j.getFiles("", nil, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, files)
+}
+
+func (j *jobs) removeFile(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	f, err := j.getFile(id)
+	if err == errFileNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	inUse, err := j.fileInUse(f.FileName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": errFileInUse.Error(),
+		})
+		return
+	}
+	if err := removeUpload(j.conf.InjectionsPath + "/" + f.FileName); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := j.deleteFile(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":   id,
+		"file": f.FileName,
+	}).Info("file deleted")
+	c.JSON(http.StatusOK, struct{}{})
+}
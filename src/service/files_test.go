@@ -0,0 +1,72 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+	"github.com/linkit360/go-jobs/src/msisdn"
+)
+
+func TestPreview(t *testing.T) {
+	saved := svc.jobs
+	defer func() { svc.jobs = saved }()
+	dir, err := ioutil.TempDir("", "files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	svc.jobs = &jobs{conf: config.JobsConfig{InjectionsPath: dir, CheckBatchSize: 2, DefaultOperator: 41001, Operators: map[int64]config.OperatorConfig{
+		41001: {CountryCode: 92, Prefixes: []string{"9230"}, Requests: "mobilink_requests"},
+	}}}
+
+	lines := filepath.Join(dir, "msisdns.txt")
+	assert.NoError(t, ioutil.WriteFile(lines, []byte("923001112233\n"+
+		"03001112233\n"+
+		"923004445566\n"+
+		"92300x1234567\n"+
+		"923451234567\n"+
+		"\n"), 0644))
+	pr, err := svc.jobs.preview(lines, Params{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), pr.Lines)
+	assert.Equal(t, int64(2), pr.Valid)
+	assert.Equal(t, int64(1), pr.Duplicates, "the same msisdn in the national form")
+	assert.Equal(t, map[string]int64{
+		string(msisdn.ReasonChars):    1,
+		string(msisdn.ReasonOperator): 1,
+		string(msisdn.ReasonEmpty):    1,
+	}, pr.Invalid)
+	assert.Nil(t, pr.Paid, "not requested")
+
+	csv := filepath.Join(dir, "msisdns.csv")
+	assert.NoError(t, ioutil.WriteFile(csv, []byte("msisdn,service_code,priority\n"+
+		"923001112233,111,1\n"+
+		"923001112233,222,1\n"+
+		"923004445566,111,10\n"), 0644))
+	pr, err = svc.jobs.preview(csv, Params{Format: formatCSV})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), pr.Lines, "without the header")
+	assert.Equal(t, int64(2), pr.Valid, "the services differ")
+	assert.Equal(t, int64(1), pr.Invalid[actionInvalidRow])
+
+	_, err = svc.jobs.preview(filepath.Join(dir, "missing.txt"), Params{})
+	assert.Error(t, err)
+
+	p, err := previewParams("msisdns.txt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, Params{}, p, "no params")
+	_, err = previewParams("msisdns.txt", `{"format": "xml"}`)
+	assert.Error(t, err)
+	_, err = previewParams("msisdns.txt", `{"service_code": "111", "last_charge_at": "yesterday"}`)
+	assert.Error(t, err)
+	_, err = previewParams("msisdns.txt", `{"never": 30}`)
+	assert.Error(t, err, "service_code required for lines")
+	_, err = previewParams("msisdns.txt", `{"service_code": "111", "nevr": 30}`)
+	assert.Error(t, err, "unknown field")
+	p, err = previewParams("msisdns.csv", `{"format": "csv", "never": 30}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, p.Never)
+}
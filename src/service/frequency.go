@@ -0,0 +1,71 @@
+package service
+
+// frequency cap: one charge attempt per msisdn in jobs.frequency_cap_hours across all jobs,
+// the time of the last attempt is kept in msisdn_attempts table, so it survives
+// the end of the job and the restart, and it is shared by all instances
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const actionCapped = "frequency capped"
+
+func (j *Job) frequencyCap() time.Duration {
+	hours := svc.jobs.conf.FrequencyCapHours
+	if j.ParsedParams.FrequencyCapHours > 0 {
+		hours = j.ParsedParams.FrequencyCapHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// takeAttempt records the attempt if the msisdn wasn't charged within the cap,
+// false means it was
+func (j *jobs) takeAttempt(msisdn string, id int64, now time.Time, cap time.Duration) (ok bool, err error) {
+	query := fmt.Sprintf("INSERT INTO %smsisdn_attempts AS a (msisdn, last_attempt_at, id_job) "+
+		" VALUES ($1, $2, $3) "+
+		" ON CONFLICT (msisdn) DO UPDATE SET last_attempt_at = EXCLUDED.last_attempt_at, id_job = EXCLUDED.id_job "+
+		" WHERE a.last_attempt_at <= $4 RETURNING msisdn",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query, msisdn, now, id, now.Add(-cap)).Scan(&msisdn); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return true, nil
+}
+
+// attemptFree tells if the msisdn wasn't charged within the cap, nothing is recorded
+func (j *jobs) attemptFree(msisdn string, now time.Time, cap time.Duration) (ok bool, err error) {
+	query := fmt.Sprintf("SELECT 1 FROM %smsisdn_attempts WHERE msisdn = $1 AND last_attempt_at > $2",
+		svc.conf.db.TablePrefix,
+	)
+	var one int
+	if err = svc.dbConn.QueryRow(query, msisdn, now.Add(-cap)).Scan(&one); err != nil {
+		if err == sql.ErrNoRows {
+			return true, nil
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return false, nil
+}
+
+// releaseAttempt forgets the attempt which wasn't sent
+func (j *jobs) releaseAttempt(msisdn string, id int64, at time.Time) (err error) {
+	query := fmt.Sprintf("DELETE FROM %smsisdn_attempts WHERE msisdn = $1 AND id_job = $2 AND last_attempt_at = $3",
+		svc.conf.db.TablePrefix,
+	)
+	if _, err = svc.dbConn.Exec(query, msisdn, id, at); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package service
+
+// input files of the injections: plain, .gz, .bz2 or .zip,
+// the files of .zip are read one after another ordered by name as one stream,
+// so skip counts the lines of the same stream on every start
+
+import (
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// openInput opens the file for reading the lines
+func openInput(path string) (io.ReadCloser, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".zip" {
+		return openZip(path)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %s, path: %s", err.Error(), path)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		gz, err := gzip.NewReader(fh)
+		if err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("gzip.NewReader: %s, path: %s", err.Error(), path)
+		}
+		return &readCloser{Reader: gz, closers: []io.Closer{gz, fh}}, nil
+	case ".bz2":
+		return &readCloser{Reader: bzip2.NewReader(fh), closers: []io.Closer{fh}}, nil
+	}
+	return fh, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() (err error) {
+	for _, c := range rc.closers {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// zipStream reads the files of the archive one by one,
+// the last line of the file is ended if it isn't, so it doesn't stick to the next file
+type zipStream struct {
+	archive *zip.ReadCloser
+	files   []*zip.File
+	current io.ReadCloser
+	last    byte // the last byte of the current file
+}
+
+func openZip(path string) (io.ReadCloser, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("zip.OpenReader: %s, path: %s", err.Error(), path)
+	}
+	z := &zipStream{archive: archive}
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		z.files = append(z.files, f)
+	}
+	if len(z.files) == 0 {
+		archive.Close()
+		return nil, fmt.Errorf("empty archive: %s", path)
+	}
+	sort.Slice(z.files, func(a, b int) bool { return z.files[a].Name < z.files[b].Name })
+	return z, nil
+}
+
+func (z *zipStream) Read(p []byte) (int, error) {
+	for {
+		if z.current == nil {
+			if len(z.files) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := z.files[0].Open()
+			if err != nil {
+				return 0, fmt.Errorf("zip open %s: %s", z.files[0].Name, err.Error())
+			}
+			z.current, z.files, z.last = rc, z.files[1:], '\n'
+		}
+		n, err := z.current.Read(p)
+		if n > 0 {
+			z.last = p[n-1]
+			return n, nil
+		}
+		if err == io.EOF {
+			z.current.Close()
+			z.current = nil
+			if z.last != '\n' {
+				z.last = '\n'
+				return copy(p, []byte{'\n'}), nil
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (z *zipStream) Close() error {
+	if z.current != nil {
+		z.current.Close()
+	}
+	return z.archive.Close()
+}
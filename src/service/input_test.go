@@ -0,0 +1,71 @@
+package service
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readInput(t *testing.T, path string) string {
+	fh, err := openInput(path)
+	if !assert.NoError(t, err, path) {
+		return ""
+	}
+	defer fh.Close()
+	data, err := ioutil.ReadAll(fh)
+	assert.NoError(t, err, path)
+	return string(data)
+}
+
+func TestOpenInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "input")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "plain.txt")
+	assert.NoError(t, ioutil.WriteFile(plain, []byte("923001112233\n"), 0644))
+	assert.Equal(t, "923001112233\n", readInput(t, plain))
+
+	gz := filepath.Join(dir, "msisdns.GZ")
+	fh, _ := os.Create(gz)
+	w := gzip.NewWriter(fh)
+	w.Write([]byte("923001112233\n923004445566\n"))
+	w.Close()
+	fh.Close()
+	assert.Equal(t, "923001112233\n923004445566\n", readInput(t, gz))
+
+	bz2 := filepath.Join(dir, "msisdns.bz2")
+	data, _ := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWXuMjQEAAAxIAAAQfyAgADEGTEEeoaTyj40RK8rEyO5XxdyRThQkHuMjQEA=")
+	assert.NoError(t, ioutil.WriteFile(bz2, data, 0644))
+	assert.Equal(t, "923001112233\n923004445566\n", readInput(t, bz2))
+
+	// the files are ordered by name, the last line without newline is ended
+	archive := filepath.Join(dir, "msisdns.zip")
+	fh, _ = os.Create(archive)
+	zw := zip.NewWriter(fh)
+	for _, f := range []struct{ name, body string }{
+		{"b.txt", "923004445566\n"},
+		{"a.txt", "923001112233"},
+		{"dir/", ""},
+		{"__MACOSX/._a.txt", "garbage"},
+		{"dir/c.txt", "923007778899\n"},
+	} {
+		fw, err := zw.Create(f.name)
+		assert.NoError(t, err)
+		fw.Write([]byte(f.body))
+	}
+	zw.Close()
+	fh.Close()
+	assert.Equal(t, "923001112233\n923004445566\n923007778899\n", readInput(t, archive))
+
+	broken := filepath.Join(dir, "broken.gz")
+	assert.NoError(t, ioutil.WriteFile(broken, []byte("not gzip"), 0644))
+	_, err = openInput(broken)
+	assert.Error(t, err, "broken gzip")
+}
@@ -1,24 +1,19 @@
 package service
 
 import (
-	"bufio"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/linkit360/go-jobs/src/config"
-	mid_client "github.com/linkit360/go-mid/rpcclient"
-	"github.com/linkit360/go-mid/service"
 	"github.com/linkit360/go-utils/amqp"
 	"github.com/linkit360/go-utils/db"
 	logger "github.com/linkit360/go-utils/log"
@@ -30,43 +25,104 @@ func init() {
 }
 
 type jobs struct {
-	running map[int64]*Job
-	slave   *sql.DB
-	conf    config.JobsConfig
-	cache   map[int64]map[string]struct{}
+	registry  *registry
+	scheduler *scheduler
+	limits    *limits
+	lists     *msisdnLists
+	slave     *sql.DB
+	conf      config.JobsConfig
 }
 
 type Job struct {
-	Id            int64          `json:"id"`
-	UserId        int64          `json:"user_id"`
-	CreatedAt     time.Time      `json:"created_at"`
-	RunAt         time.Time      `json:"run_at"`
-	Type          string         `json:"type"`
-	Status        string         `json:"status"`
-	FileName      string         `json:"file_name,omitempty"`
-	Params        string         `json:"params,omitempty"`
-	PriceCents    int            `json:"-"`
-	Skip          int64          `json:"skip,omitempty"`
-	Processed     int64          `json:"processed,omitempty"`
-	StopRequested bool           `json:"-"`
-	ParsedParams  Params         `json:"parsed_params,omitempty"`
-	fh            *os.File       `json:"-"`
-	scanner       *bufio.Scanner `json:"-"`
-	log           *log.Logger    `json:"-"`
-	finished      bool           `json:"finished"`
+	Id             int64     `json:"id"`
+	UserId         int64     `json:"user_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	RunAt          time.Time `json:"run_at"`
+	Type           string    `json:"type"`
+	Status         string    `json:"status"`
+	FileName       string    `json:"file_name,omitempty"`
+	Params         string    `json:"params,omitempty"`
+	PriceCents     int       `json:"-"`
+	Skip           int64     `json:"skip,omitempty"`
+	LastKey        string    `json:"last_key,omitempty"` // of the item before skip, expired jobs are resumed after it
+	Processed      int64     `json:"processed,omitempty"`
+	StopRequested  bool      `json:"-"`
+	PauseRequested bool      `json:"-"`
+	ParsedParams   Params    `json:"parsed_params,omitempty"`
+	Stats          Stats     `json:"stats,omitempty"`
+	Owner          string    `json:"owner,omitempty"` // instance which has claimed the job
+	LostClaim      bool      `json:"-"`
+	Rate           float64   `json:"rate,omitempty"`       // effective limit, messages per second
+	Spent          int64     `json:"spent,omitempty"`      // cents of the sent charge requests
+	Throughput     float64   `json:"throughput,omitempty"` // items processed per second since the start
+	Exhausted      bool      `json:"-"`
+	limiter        *jobLimiter
+	interrupt      chan struct{} // closed when the job is asked to stop
+	retry          bool          // the current item wasn't charged
+	window         *sendWindow
+	windowOpenedAt time.Time // the job waited for the window until
+	today          daily
+	startedAt      time.Time
+	startProcessed int64
+	runner         JobRunner   `json:"-"`
+	log            *log.Logger `json:"-"`
+	finished       bool
+	resumed        bool
+	offset         int64
+}
+
+// unfinishedStatuses are of the jobs which could still run or be resumed
+var unfinishedStatuses = []string{"ready", "in progress", "paused", "interrupted", statusWaiting, statusBudgetExhausted}
+
+func unfinished(status string) bool {
+	for _, s := range unfinishedStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
 }
 
 // XXX: when release, update jobs also
 type Params struct {
-	DateFrom     string `json:"date_from,omitempty"`
-	DateTo       string `json:"date_to,omitempty"`
-	Count        int64  `json:"count,omitempty"`
-	Order        string `json:"order,omitempty"`
-	Never        int    `json:"never,omitempty"`
-	ServiceCode  string `json:"service_code,omitempty"`
-	CampaignId   string `json:"campaign_id,omitempty"`
-	DryRun       bool   `json:"dry_run,omitempty"`
-	LastChargeAt string `json:"last_charge_at,omitempty"`
+	DateFrom      string  `json:"date_from,omitempty"`
+	DateTo        string  `json:"date_to,omitempty"`
+	Count         int64   `json:"count,omitempty"`
+	Order         string  `json:"order,omitempty"`
+	Never         int     `json:"never,omitempty"`
+	ServiceCode   string  `json:"service_code,omitempty"`
+	CampaignId    string  `json:"campaign_id,omitempty"`
+	DryRun        bool    `json:"dry_run,omitempty"`
+	LastChargeAt  string  `json:"last_charge_at,omitempty"`
+	Missed        string  `json:"missed,omitempty"` // run_now, skip or grace
+	GraceMinutes  int     `json:"grace_minutes,omitempty"`
+	Rate          float64 `json:"rate,omitempty"`            // messages per second, jobs.rate_limit by default
+	RampUpSeconds int     `json:"ramp_up_seconds,omitempty"` // jobs.ramp_up_seconds by default
+	// send windows, jobs.calendar by default
+	Timezone  string   `json:"timezone,omitempty"`
+	Windows   []string `json:"windows,omitempty"`   // 09:00-21:00
+	Blackouts []string `json:"blackouts,omitempty"` // 2017-08-14, added to the calendar ones
+	// budget caps, 0 is unlimited
+	Budget    int64 `json:"budget,omitempty"`      // cents
+	MaxPerDay int64 `json:"max_per_day,omitempty"` // charge attempts
+	// one attempt per msisdn in hours across all jobs, jobs.frequency_cap_hours by default
+	FrequencyCapHours int `json:"frequency_cap_hours,omitempty"`
+	// the operator of injection, jobs.default_operator by default,
+	// expired charges every operator of retries_expired if not set
+	OperatorCode int64 `json:"operator_code,omitempty"`
+	// expired filters
+	Sort               string  `json:"sort,omitempty"` // the retry of the msisdn is chosen by: id, created_at, last_pay_attempt_at or attempts_count
+	AttemptsFrom       int     `json:"attempts_from,omitempty"`
+	AttemptsTo         int     `json:"attempts_to,omitempty"`
+	LastPayAttemptFrom string  `json:"last_pay_attempt_from,omitempty"`
+	LastPayAttemptTo   string  `json:"last_pay_attempt_to,omitempty"`
+	SubscriptionIds    []int64 `json:"subscription_ids,omitempty"`
+	// charge the msisdns from msisdn_blacklist and msisdn_postpaid, for the test numbers
+	IgnoreLists bool `json:"ignore_lists,omitempty"`
+	// injection file: lines (default) of msisdns or csv with the overrides of the params
+	Format string `json:"format,omitempty"`
+	// blacklist or postpaid, the list the list_import job adds the msisdns to
+	List string `json:"list,omitempty"`
 }
 
 func (p Params) ToString() string {
@@ -76,10 +132,23 @@ func (p Params) ToString() string {
 
 func initJobs(jConf config.JobsConfig, dbSlaveConf db.DataBaseConfig) *jobs {
 	jobs := &jobs{
-		running: make(map[int64]*Job),
-		cache:   make(map[int64]map[string]struct{}),
-		conf:    jConf,
-		slave:   db.Init(dbSlaveConf),
+		registry:  newRegistry(),
+		scheduler: newScheduler(),
+		limits:    newLimits(jConf),
+		lists:     newMsisdnLists(),
+		conf:      jConf,
+		slave:     db.Init(dbSlaveConf),
+	}
+	jobs.conf.InstanceId = instanceId(jConf.InstanceId)
+	if err := initOperators(&jobs.conf); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Fatal("jobs.operators")
+	}
+	if _, err := jobWindow(jConf.Calendar, config.OperatorConfig{}, Params{}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Fatal("jobs.calendar")
 	}
 	if jConf.PlannedEnabled {
 		go jobs.planned()
@@ -89,36 +158,56 @@ func initJobs(jConf config.JobsConfig, dbSlaveConf db.DataBaseConfig) *jobs {
 		}).Info("run planned disabled")
 	}
 
+	if jConf.Watch.Enabled {
+		if err := checkWatch(jConf.Watch); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatal("jobs.watch")
+		}
+		go jobs.watch()
+	}
+
 	go jobs.stopJobs()
+	go jobs.checkpoints()
+	go jobs.heartbeats()
+	go jobs.refreshLists()
 	return jobs
 }
 func AddJobHandlers(r *gin.Engine) {
 	rg := r.Group("/jobs")
 	rg.Group("/start").GET("", svc.jobs.start)
 	rg.Group("/stop").GET("", svc.jobs.stop)
+	rg.Group("/pause").GET("", svc.jobs.pause)
+	rg.Group("/resume").GET("", svc.jobs.resume)
 	rg.Group("/status").GET("", svc.jobs.status)
-}
-
-func (j *jobs) planned() {
-	for range time.Tick(time.Duration(j.conf.PlannedPeriodMinutes) * time.Minute) {
-		jobs, err := j.getList("ready")
-		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("cannt process")
-			return
-		}
-
-		for _, job := range jobs {
-			if time.Now().Sub(job.RunAt).Seconds() > 10 && job.Status == "ready" {
-				if err = svc.jobs.startJob(job.Id); err != nil {
-					log.WithFields(log.Fields{
-						"error": err.Error(),
-					}).Error("cannt process")
-				}
-			}
-		}
-	}
+	rg.Group("/planned").GET("", svc.jobs.plannedRuns)
+
+	rg.POST("", svc.jobs.create)
+	rg.GET("", svc.jobs.list)
+	// the job by id is under /id, the wildcard can't sit beside the actions above
+	rg.GET("/id/:id", svc.jobs.read)
+	rg.PATCH("/id/:id", svc.jobs.update)
+	rg.DELETE("/id/:id", svc.jobs.remove)
+	rg.GET("/id/:id/report", svc.jobs.report)
+
+	rt := r.Group("/templates")
+	rt.POST("", svc.jobs.createTemplate)
+	rt.GET("", svc.jobs.listTemplates)
+	rt.GET("/:id", svc.jobs.readTemplate)
+	rt.PATCH("/:id", svc.jobs.updateTemplate)
+	rt.DELETE("/:id", svc.jobs.removeTemplate)
+
+	rl := r.Group("/lists/:list")
+	rl.POST("", svc.jobs.addToList)
+	rl.GET("/:msisdn", svc.jobs.lookupList)
+	rl.DELETE("/:msisdn", svc.jobs.removeFromList)
+	rl.POST("/import", svc.jobs.importList)
+
+	rf := r.Group("/files")
+	rf.POST("", svc.jobs.uploadFile)
+	rf.GET("", svc.jobs.listFiles)
+	rf.GET("/:id", svc.jobs.readFile)
+	rf.DELETE("/:id", svc.jobs.removeFile)
 }
 
 func (j *jobs) start(c *gin.Context) { // start?id=132123
@@ -162,7 +251,7 @@ func (j *jobs) stop(c *gin.Context) {
 		})
 		return
 	}
-	if err := j.stopJob(id, "canceled"); err != nil {
+	if err := j.stopJob(id); err != nil {
 		err = fmt.Errorf("j.stopJob: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
@@ -171,25 +260,90 @@ func (j *jobs) stop(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, struct{}{})
 }
-func (j *jobs) status(c *gin.Context) {
-	jobs, err := j.getList("in progress")
+func (j *jobs) pause(c *gin.Context) {
+	idStr, ok := c.GetQuery("id")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "id required",
+		})
+		return
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
+		err = fmt.Errorf("strconv.ParseInt: :%s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := j.pauseJob(id); err != nil {
+		err = fmt.Errorf("j.pauseJob: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
+	c.JSON(http.StatusOK, struct{}{})
+}
+func (j *jobs) resume(c *gin.Context) {
+	idStr, ok := c.GetQuery("id")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "id required",
+		})
+		return
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("strconv.ParseInt: :%s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := j.resumeJob(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, struct{}{})
+}
+func (j *jobs) status(c *gin.Context) {
+	jobs := j.registry.snapshot()
+	for i := range jobs {
+		jobs[i].Rate = j.limits.effective(jobs[i])
+		jobs[i].Throughput = jobs[i].throughput()
+	}
 	c.JSON(http.StatusOK, jobs)
 }
 func (j *jobs) startJob(id int64) error {
 	log.WithFields(log.Fields{
 		"id": id,
 	}).Info("start")
+	return j.launchJob(id, false)
+}
+
+// resumeJob continues the paused (or interrupted) job from the checkpoint saved by setSkip:
+// the injection file is opened again and everything before the checkpoint is skipped,
+// the expired query continues after the last key
+func (j *jobs) resumeJob(id int64) error {
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Info("resume")
+	return j.launchJob(id, true)
+}
+
+func (j *jobs) launchJob(id int64, resume bool) error {
 	job, err := j.get(id)
 	if err != nil {
 		return err
 	}
-	if job.Status != "ready" {
+	allowed := job.Status == "ready"
+	if resume {
+		allowed = job.Status == "paused" || job.Status == "interrupted" || job.Status == statusBudgetExhausted
+	}
+	if !allowed {
 		err = fmt.Errorf("Job status: %s", job.Status)
 		log.WithFields(log.Fields{
 			"id":    id,
@@ -206,36 +360,16 @@ func (j *jobs) startJob(id int64) error {
 		return err
 	}
 
-	if job.Type == "injection" {
-		s, err := mid_client.GetServiceByCode(job.ParsedParams.ServiceCode)
-		if err != nil {
-			err = fmt.Errorf("mid_client.GetServiceByCode: %s", err.Error())
-			log.WithFields(log.Fields{
-				"id":      job.Id,
-				"jobStop": err.Error(),
-			}).Info("exiting")
-			return err
-		}
-		job.PriceCents = s.PriceCents
-
-		var camp service.Campaign
-		camp, err = mid_client.GetCampaignByServiceCode(job.ParsedParams.ServiceCode)
-		if err != nil {
-			err = fmt.Errorf("mid_client.GetCampaignByServiceCode: %s", err.Error())
-			log.WithFields(log.Fields{
-				"id":      job.Id,
-				"jobStop": err.Error(),
-			}).Info("exiting")
-			return err
-		}
-		if job.ParsedParams.CampaignId == "" {
-			job.ParsedParams.CampaignId = camp.Id
-		}
-
+	_, operator, err := j.jobOperator(job.ParsedParams)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Info("failed")
+		return err
 	}
-
-	if err := svc.jobs.setStatus(id, "in progress"); err != nil {
-		err = fmt.Errorf("jobs.setStatus: %s", err.Error())
+	if job.window, err = jobWindow(j.conf.Calendar, operator, job.ParsedParams); err != nil {
+		err = fmt.Errorf("jobWindow: %s", err.Error())
 		log.WithFields(log.Fields{
 			"id":    id,
 			"error": err.Error(),
@@ -243,31 +377,26 @@ func (j *jobs) startJob(id int64) error {
 		return err
 	}
 
-	path := svc.jobs.conf.LogPath + "jobs_" + strconv.FormatInt(time.Now().Unix(), 10) + ".log"
-	job.log = logger.GetFileLogger(path)
-	if err := svc.jobs.setLog(id, path); err != nil {
-		err = fmt.Errorf("jobs.setLog: %s", err.Error())
+	runner, err := newRunner(job.Type)
+	if err != nil {
+		if err := j.setStatus(id, "error"); err != nil {
+			log.WithFields(log.Fields{
+				"id":    id,
+				"error": err.Error(),
+			}).Info("failed to set job status")
+		}
 		log.WithFields(log.Fields{
 			"id":    id,
 			"error": err.Error(),
 		}).Info("failed")
 		return err
 	}
+	job.runner = runner
 
-	svc.jobs.cache[id] = make(map[string]struct{})
-	svc.jobs.running[id] = &job
-
-	if job.Type == "injection" {
-		if err := svc.jobs.running[id].openFile(); err != nil {
-			if err := svc.jobs.setStatus(id, "error"); err != nil {
-				err = fmt.Errorf("jobs.setStatus: %s", err.Error())
-				log.WithFields(log.Fields{
-					"id":    id,
-					"error": err.Error(),
-				}).Info("failed to set job status")
-				return err
-			}
-			err = fmt.Errorf("run job: %s", err.Error())
+	job.resumed = resume
+	job.Stats = make(Stats)
+	if resume {
+		if job.Stats, err = j.getStats(id); err != nil {
 			log.WithFields(log.Fields{
 				"id":    id,
 				"error": err.Error(),
@@ -275,391 +404,234 @@ func (j *jobs) startJob(id int64) error {
 			return err
 		}
 	}
-
-	svc.jobs.running[id].run()
-	return nil
-}
-
-func (j *Job) run() {
-	log.WithFields(log.Fields{
-		"id":   j.Id,
-		"skip": j.Skip,
-	}).Info("run")
-
-	go func() {
-		for {
-			if j.Type == "expired" {
-				expired, err := svc.jobs.getExpiredList(j.ParsedParams)
-				if err != nil {
-					err = fmt.Errorf("svc.jobs.getExpiredList: %s", err.Error())
-					svc.jobs.running[j.Id].finished = true
-					svc.jobs.running[j.Id].Status = "error"
-					log.WithFields(log.Fields{
-						"error":    err.Error(),
-						"finished": svc.jobs.running[j.Id].finished,
-					}).Error("cannt process")
-					return
-				}
-				for _, r := range expired {
-					if j.StopRequested || svc.exiting {
-						svc.jobs.running[j.Id].finished = true
-						svc.jobs.running[j.Id].Status = "canceled"
-						log.WithFields(log.Fields{
-							"jobStop":  j.StopRequested,
-							"service":  svc.exiting,
-							"finished": svc.jobs.running[j.Id].finished,
-						}).Info("exiting")
-						return
-					}
-					if r.RetryId < j.Skip {
-						log.WithFields(log.Fields{
-							"tid": r.Tid,
-							"id":  r.RetryId,
-						}).Info("skip")
-						j.logMsisdn(r.RetryId, r.Msisdn, "skip", nil)
-						continue
-					}
-					log.WithFields(log.Fields{
-						"tid": r.Tid,
-					}).Info("process")
-
-					if j.ParsedParams.ServiceCode != "" {
-						r.ServiceCode = j.ParsedParams.ServiceCode
-					}
-					if j.ParsedParams.CampaignId != "" {
-						r.CampaignId = j.ParsedParams.CampaignId
-					}
-
-					if _, ok := svc.jobs.cache[j.Id][r.Msisdn]; ok {
-						log.WithFields(log.Fields{
-							"tid": r.Tid,
-						}).Info("duplicate")
-
-						j.logMsisdn(r.RetryId, r.Msisdn, "duplicate skip", nil)
-						continue
-					} else {
-						svc.jobs.cache[j.Id][r.Msisdn] = struct{}{}
-					}
-
-					r.Type = "expired"
-					j.Skip = r.RetryId
-					r.Price = j.PriceCents
-					r.OperatorCode = 41001
-					r.AttemptsCount = 10 // any, just more than 0
-
-				send:
-					if err := j.sendToMobilinkRequests(0, r); err != nil {
-						log.WithFields(log.Fields{
-							"error": err.Error(),
-							"id":    r.RetryId,
-						}).Error("cannt process")
-						time.Sleep(time.Second)
-						goto send
-					}
-					j.logMsisdn(r.RetryId, r.Msisdn, "sent", nil)
-				}
-				svc.jobs.running[j.Id].finished = true
-				svc.jobs.running[j.Id].Status = "done"
-				log.WithFields(log.Fields{
-					"id":       j.Id,
-					"count":    len(expired),
-					"finished": svc.jobs.running[j.Id].finished,
-				}).Info("done")
-				return
-			}
-			if j.Type == "injection" {
-				defer j.closeJob()
-
-				var i int64
-				j.Processed = 0
-				for {
-					if j.ParsedParams.Count > 0 && j.Processed >= j.ParsedParams.Count {
-						svc.jobs.running[j.Id].finished = true
-						svc.jobs.running[j.Id].Status = "done"
-						return
-					}
-
-					if j.StopRequested || svc.exiting {
-						log.WithFields(log.Fields{
-							"jobStop": j.StopRequested,
-							"service": svc.exiting,
-						}).Info("exiting")
-						svc.jobs.running[j.Id].finished = true
-						svc.jobs.running[j.Id].Status = "canceled"
-
-						return
-					}
-
-					j.processInjection(i)
-					i++
-				}
-			}
-		}
-		return
-	}()
-	return
-}
-func (j *Job) processInjection(i int64) {
-	var action string
-	orig, msisdn, err := j.nextMsisdn(i)
-	defer func() {
-		j.logMsisdn(i, orig, action, err)
-	}()
-	if i < j.Skip {
-		action = "skip"
+	if _, ok := j.registry.get(id); ok {
+		err = fmt.Errorf("Already running: %d", id)
 		log.WithFields(log.Fields{
-			"reason": err.Error(),
-		}).Warn("skip")
-		return
+			"id":    id,
+			"error": err.Error(),
+		}).Info("failed")
+		return err
 	}
 
-	log.WithFields(log.Fields{
-		"idx":        i,
-		"msisdn":     msisdn,
-		"orig":       orig,
-		"skip":       j.Skip,
-		"processsed": j.Processed,
-	}).Debug("consider..")
-	j.Processed = j.Processed + 1
-
-	if err == errPaidInTransactions {
-		action = "skip"
-		log.WithFields(log.Fields{
-			"msisdn": msisdn,
-		}).Warn("already paid")
-		return
+	// the job is claimed before it is prepared,
+	// so the instances which lose the race for it don't open the file and query the slave for nothing
+	from := []string{"ready"}
+	if resume {
+		from = []string{"paused", "interrupted", statusBudgetExhausted}
 	}
-
-	if err != nil {
-		action = "skip"
+	if err := j.claim(id, from...); err != nil {
+		err = fmt.Errorf("jobs.claim: %s", err.Error())
 		log.WithFields(log.Fields{
-			"orig":   orig,
-			"msisdn": msisdn,
-			"error":  err.Error(),
-		}).Error("skip")
-		return
+			"id":    id,
+			"error": err.Error(),
+		}).Info("failed")
+		return err
 	}
 
-	if _, ok := svc.jobs.cache[j.Id][msisdn]; ok {
+	// everything is set up before the job gets into the registry,
+	// after that it is shared with other goroutines
+	if err := runner.Prepare(&job); err != nil {
+		err = fmt.Errorf("%s prepare: %s", job.Type, err.Error())
+		j.unclaim(id, job.Status)
 		log.WithFields(log.Fields{
-			"msisdn": msisdn,
-		}).Info("duplicate")
-		action = "skip duplicate"
-		return
-	} else {
-		svc.jobs.cache[j.Id][msisdn] = struct{}{}
+			"id":    id,
+			"error": err.Error(),
+		}).Info("failed")
+		return err
 	}
-
-	if msisdn == "" && err == nil {
-		log.WithFields(log.Fields{"count": i}).Info("done")
-		svc.jobs.running[j.Id].finished = true
-		svc.jobs.running[j.Id].Status = "done"
-		return
+	if job.today, err = j.getDaily(id, today(&job)); err != nil {
+		runner.Finalize(&job)
+		j.unclaim(id, job.Status)
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Info("failed")
+		return err
 	}
 
-	r := rec.Record{
-		CampaignId:    j.ParsedParams.CampaignId,
-		ServiceCode:   j.ParsedParams.ServiceCode,
-		OperatorCode:  41001,
-		CountryCode:   92,
-		Msisdn:        msisdn,
-		Tid:           rec.GenerateTID(msisdn),
-		Price:         j.PriceCents,
-		AttemptsCount: 10, // any, just more than 0
-		Type:          "injection",
+	path := j.conf.LogPath + "jobs_" + strconv.FormatInt(time.Now().Unix(), 10) + ".log"
+	job.log = logger.GetFileLogger(path)
+	job.limiter = newJobLimiter()
+	job.startedAt = time.Now()
+	job.startProcessed = job.Processed
+	status := job.Status
+	job.Status = "in progress"
+
+	if err := j.registry.add(&job); err != nil {
+		runner.Finalize(&job)
+		j.unclaim(id, status)
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Info("failed")
+		return err
 	}
 
-	log.WithFields(log.Fields{
-		"tid":    r.Tid,
-		"msisdn": r.Msisdn,
-	}).Info("process")
-
-send:
-	if err := j.sendToMobilinkRequests(0, r); err != nil {
+	if err := j.setLog(id, path); err != nil {
+		err = fmt.Errorf("jobs.setLog: %s", err.Error())
 		log.WithFields(log.Fields{
+			"id":    id,
 			"error": err.Error(),
-			"id":    r.RetryId,
-		}).Error("cannt process")
-		time.Sleep(time.Second)
-		goto send
+		}).Error("failed")
 	}
-	action = "sent"
-}
-func (j *Job) openFile() error {
-	var err error
-	if j.FileName == "" {
-		return fmt.Errorf("File name is empty: %s", j.FileName)
-	}
-
-	path := svc.jobs.conf.InjectionsPath + "/" + j.FileName
-	j.fh, err = os.Open(path)
-	if err != nil {
-		return fmt.Errorf("os.Open: %s, path: %s", err.Error(), path)
 
-	}
-	log.WithFields(log.Fields{
-		"id":   j.Id,
-		"path": path,
-	}).Info("opened")
-	j.scanner = bufio.NewScanner(j.fh)
+	job.run()
 	return nil
 }
-func TrimToNum(r rune) bool {
-	return !unicode.IsDigit(r)
-}
-
-var errPaidInTransactions = errors.New("Paid in transactions")
 
-func (j *Job) nextMsisdn(idx int64) (orig, msisdn string, err error) {
+var errJobNotFound = errors.New("Job not found")
 
-	if !j.scanner.Scan() {
-		if err = j.scanner.Err(); err != nil {
-			err = fmt.Errorf("scanner.Error: %s", err.Error())
-			return
-		}
-		// eof
-		return "", "", nil
+func (j *Job) exitStatus() string {
+	if j.PauseRequested {
+		return "paused"
 	}
+	return "canceled"
+}
 
-	orig = j.scanner.Text()
-
-	if idx < j.Skip {
-		err = fmt.Errorf("%d skip until: %d", idx, j.Skip)
-		return
+// checkpoint is the index of the first line (or expired record)
+// which wasn't processed yet, it is saved in skip column
+func (j *Job) checkpoint() int64 {
+	if j.offset < j.Skip {
+		return j.Skip
 	}
+	return j.offset
+}
 
+// pauseJob only asks the job to stop,
+// the job goroutine exits with status "paused" and stopJobs saves the checkpoint
+func (j *jobs) pauseJob(id int64) error {
 	log.WithFields(log.Fields{
-		"original": orig,
-	}).Info("got from file")
+		"id": id,
+	}).Info("pause...")
+	return j.registry.requestStop(id, true)
+}
 
-	msisdn = strings.TrimFunc(orig, TrimToNum)
-	if len(msisdn) > 20 {
-		err = fmt.Errorf("Too long msisdn, length: %d", len(msisdn))
-		return
-	}
-	if len(msisdn) < 5 {
-		err = fmt.Errorf("Too short msisdn, length: %d", len(msisdn))
-		return
-	}
-	if !strings.HasPrefix(msisdn, svc.jobs.conf.CheckPrefix) {
-		err = fmt.Errorf("Wrong prefix: %s", msisdn)
-		return
+// stopJob asks the job to stop, the job is finished with status "canceled" by stopJobs
+func (j *jobs) stopJob(id int64) error {
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Info("stop...")
+	return j.registry.requestStop(id, false)
+}
+
+// finishJob saves the status and the checkpoint of the job which goroutine has exited
+func (j *jobs) finishJob(job Job) error {
+	status := "done"
+	if job.Status != "" {
+		status = job.Status
 	}
-	if j.ParsedParams.LastChargeAt != "" {
-		var one int
+	if status == statusLost {
+		j.registry.remove(job.Id)
 		log.WithFields(log.Fields{
-			"last_charge_at": j.ParsedParams.LastChargeAt,
-			"msisdn":         msisdn,
-		}).Info("check")
-		query := fmt.Sprintf("SELECT 1 FROM %stransactions "+
-			" WHERE ( result = 'paid' OR result = 'retry_paid') AND "+
-			" sent_at > $1 AND msisdn = $2 LIMIT 1", svc.conf.db.TablePrefix,
-		)
-
-		if err = svc.jobs.slave.QueryRow(query, j.ParsedParams.LastChargeAt, msisdn).Scan(&one); err != nil {
-			if err == sql.ErrNoRows {
-				err = nil
-				log.WithFields(log.Fields{
-					"last_charge_at": j.ParsedParams.LastChargeAt,
-					"msisdn":         msisdn,
-				}).Info("passed")
-				return
-			} else {
-				err = fmt.Errorf("dbConn.QueryRow.Scan: %s, query %s", err.Error(), query)
-				return
-			}
-			return "", "", errPaidInTransactions
+			"id": job.Id,
+		}).Warn("removed from running, claim lost")
+		return nil
+	}
+	// on exit the checkpoint counts the charge requests as sent,
+	// so they must leave the notifier before it is saved
+	if ctx := j.registry.exitContext(); ctx != nil {
+		if err := drainPublisher(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"id":    job.Id,
+				"error": err.Error(),
+			}).Error("publisher not drained")
 		}
 	}
-	if j.ParsedParams.Never > 0 {
-		var one int
-		log.WithFields(log.Fields{
-			"msisdn": msisdn,
-		}).Info("never?")
-		query := fmt.Sprintf("SELECT 1 FROM %stransactions "+
-			" WHERE ( result = 'paid' OR result = 'retry_paid' OR result = 'injection_paid' OR result = 'expired_paid') AND "+
-			" msisdn = $1 LIMIT 1",
-			svc.conf.db.TablePrefix,
-		)
-
-		if err = svc.jobs.slave.QueryRow(query, msisdn).Scan(&one); err != nil {
-			if err == sql.ErrNoRows {
-				err = nil
-				log.WithFields(log.Fields{
-					"never":  j.ParsedParams.Never,
-					"msisdn": msisdn,
-				}).Info("passed")
-				return
-			} else {
-				err = fmt.Errorf("dbConn.QueryRow.Scan: %s, query %s", err.Error(), query)
-				return
-			}
-			return "", "", errPaidInTransactions
+	if err := j.setStatus(job.Id, status); err != nil {
+		if err == errJobClaimed {
+			j.registry.remove(job.Id)
+			log.WithFields(log.Fields{
+				"id": job.Id,
+			}).Warn("removed from running, claim lost")
+			return nil
 		}
+		return fmt.Errorf("j.setStatus: %s", err.Error())
 	}
-	return
-}
 
-func (j *Job) closeJob() error {
-	return j.fh.Close()
-}
-func (j *jobs) stopJob(id int64, status string) error {
-	log.WithFields(log.Fields{
-		"id": id,
-	}).Info("stop...")
-	_, ok := svc.jobs.running[id]
-	if !ok {
-		return fmt.Errorf("Not found: %d", id)
+	skip := job.checkpoint()
+	if err := j.setSkip(skip, job.Processed, job.Spent, job.LastKey, job.Id); err != nil {
+		return fmt.Errorf("j.setSkip to %d: %s", skip, err.Error())
 	}
-	svc.jobs.running[id].StopRequested = true
-
-	if err := j.setStatus(id, status); err != nil {
-		return fmt.Errorf("j.setStatus: %s", err.Error())
+	if err := j.setStats(job.Id, job.Stats); err != nil {
+		return fmt.Errorf("j.setStats: %s", err.Error())
+	}
+	if err := j.setDaily(job.Id, job.today); err != nil {
+		return fmt.Errorf("j.setDaily: %s", err.Error())
 	}
 
-	//skip := svc.jobs.running[id].Skip + svc.jobs.running[id].Processed
-	//if err := j.setSkip(skip, id); err != nil {
-	//	return fmt.Errorf("j.setSkip to %d: %s", skip, err.Error())
-	//}
-
-	delete(svc.jobs.cache, id)
-	delete(svc.jobs.running, id)
+	j.registry.remove(job.Id)
 	log.WithFields(log.Fields{
-		"id": id,
+		"id":         job.Id,
+		"status":     status,
+		"throughput": job.throughput(),
 	}).Info("removed from running")
 	return nil
 }
 
 func (j *jobs) stopJobs() {
 	for range time.Tick(time.Second) {
-		for k, _ := range j.running {
-			if j.running[k].finished {
-				status := "done"
-				if svc.jobs.running[k].Status != "" {
-					status = svc.jobs.running[k].Status
-				}
-				if err := j.stopJob(k, status); err != nil {
-					log.WithFields(log.Fields{
-						"id":    k,
-						"error": err.Error(),
-					}).Error("stop")
-				} else {
-					log.WithFields(log.Fields{
-						"id": k,
-					}).Debug("finished")
-				}
+		for _, job := range j.registry.finishedJobs() {
+			if err := j.finishJob(job); err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("stop")
+			} else {
+				log.WithFields(log.Fields{
+					"id": job.Id,
+				}).Debug("finished")
 			}
 		}
 	}
 }
-func (j *jobs) getList(status string) (jobs []Job, err error) {
+
+// JobsFilter selects jobs for getList, empty fields are not used
+type JobsFilter struct {
+	Status   string
+	Type     string
+	UserId   int64
+	DateFrom time.Time // run_at >= DateFrom
+	DateTo   time.Time // run_at < DateTo
+	Limit    int
+	Offset   int
+}
+
+func (f JobsFilter) where() (string, []interface{}) {
+	args := []interface{}{}
+	wheres := []string{}
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		wheres = append(wheres, fmt.Sprintf(clause, "$"+strconv.Itoa(len(args))))
+	}
+	if f.Status != "" {
+		add("status = %s", f.Status)
+	}
+	if f.Type != "" {
+		add("type = %s", f.Type)
+	}
+	if f.UserId > 0 {
+		add("id_user = %s", f.UserId)
+	}
+	if !f.DateFrom.IsZero() {
+		add("run_at >= %s", f.DateFrom)
+	}
+	if !f.DateTo.IsZero() {
+		add("run_at < %s", f.DateTo)
+	}
+	if len(wheres) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(wheres, " AND "), args
+}
+
+func (j *jobs) getList(f JobsFilter) (jobs []Job, err error) {
 	begin := time.Now()
 	query := ""
 	defer func() {
 		defer func() {
 			fields := log.Fields{
 				"took":   time.Since(begin),
-				"status": status,
+				"filter": fmt.Sprintf("%#v", f),
 			}
 			if err != nil {
 				fields["error"] = err.Error()
@@ -672,6 +644,11 @@ func (j *jobs) getList(status string) (jobs []Job, err error) {
 		}()
 	}()
 
+	where, args := f.where()
+	limit := ""
+	if f.Limit > 0 {
+		limit = fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, f.Offset)
+	}
 	query = fmt.Sprintf("SELECT "+
 		"id, "+
 		"id_user, "+
@@ -679,16 +656,20 @@ func (j *jobs) getList(status string) (jobs []Job, err error) {
 		"run_at, "+
 		"type, "+
 		"skip, "+
+		"processed, "+
 		"status, "+
+		"owner, "+
 		"file_name, "+
 		"params "+
 		" FROM %sjobs "+
-		" WHERE status = $1 ",
+		where+
+		" ORDER BY id ASC"+
+		limit,
 		svc.conf.db.TablePrefix,
 	)
 
 	var rows *sql.Rows
-	rows, err = svc.dbConn.Query(query, status)
+	rows, err = svc.dbConn.Query(query, args...)
 	if err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
@@ -706,7 +687,9 @@ func (j *jobs) getList(status string) (jobs []Job, err error) {
 			&job.RunAt,
 			&job.Type,
 			&job.Skip,
+			&job.Processed,
 			&job.Status,
+			&job.Owner,
 			&job.FileName,
 			&job.Params,
 		); err != nil {
@@ -716,7 +699,7 @@ func (j *jobs) getList(status string) (jobs []Job, err error) {
 		}
 		jobs = append(jobs, job)
 	}
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("rows.Err: %s", err.Error())
 		return
@@ -731,9 +714,13 @@ func (j *jobs) get(id int64) (job Job, err error) {
 		"run_at, "+
 		"type, "+
 		"skip, "+
+		"processed, "+
 		"status, "+
+		"owner, "+
 		"file_name, "+
-		"params "+
+		"params, "+
+		"last_key, "+
+		"spent "+
 		" FROM %sjobs "+
 		" WHERE id = $1 LIMIT 1",
 		svc.conf.db.TablePrefix,
@@ -756,9 +743,13 @@ func (j *jobs) get(id int64) (job Job, err error) {
 			&job.RunAt,
 			&job.Type,
 			&job.Skip,
+			&job.Processed,
 			&job.Status,
+			&job.Owner,
 			&job.FileName,
 			&job.Params,
+			&job.LastKey,
+			&job.Spent,
 		); err != nil {
 			DBErrors.Inc()
 			err = fmt.Errorf("rows.Scan: %s", err.Error())
@@ -766,25 +757,36 @@ func (j *jobs) get(id int64) (job Job, err error) {
 		}
 		return
 	}
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("rows.Err: %s", err.Error())
 		return
 	}
-	err = fmt.Errorf("Not found: %d", id)
+	err = errJobNotFound
 	return
 }
+// setStatus changes the status of the job, the running job only if this instance owns it,
+// errJobClaimed means another instance runs the job (or it is deleted)
 func (j *jobs) setStatus(id int64, status string) (err error) {
-	query := fmt.Sprintf("UPDATE %sjobs SET status = $1 WHERE id = $2 ",
+	query := fmt.Sprintf("UPDATE %sjobs SET status = $1 WHERE id = $2 "+
+		" AND (status NOT IN ('in progress', 'waiting for window') OR owner = $3)",
 		svc.conf.db.TablePrefix,
 	)
-	_, err = svc.dbConn.Exec(query, status, id)
+	res, err := svc.dbConn.Exec(query, status, id, j.conf.InstanceId)
 	if err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
 		return
 	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errJobClaimed
+	}
+	j.callback(id, status)
+	return
+}
 
+// callback notifies about the new status of the job
+func (j *jobs) callback(id int64, status string) {
 	if svc.jobs.conf.CallBackUrl != "" {
 		url := fmt.Sprintf("%s?id=%d&status=%s", svc.jobs.conf.CallBackUrl, id, status)
 		resp, err := http.Get(url)
@@ -798,7 +800,6 @@ func (j *jobs) setStatus(id int64, status string) (err error) {
 		}
 		log.WithFields(fields).Info("hook call")
 	}
-	return
 }
 
 func (j *jobs) setLog(id int64, path string) (err error) {
@@ -813,30 +814,63 @@ func (j *jobs) setLog(id int64, path string) (err error) {
 	}
 	return
 }
-func (j *jobs) setSkip(skip int64, id int64) (err error) {
+func (j *jobs) setSkip(skip, processed, spent int64, lastKey string, id int64) (err error) {
 
-	query := fmt.Sprintf("UPDATE %sjobs SET skip = $1, finished_at =$2 WHERE id = $3",
+	query := fmt.Sprintf("UPDATE %sjobs SET skip = $1, processed = $2, spent = $3, last_key = $4, finished_at = $5 WHERE id = $6",
 		svc.conf.db.TablePrefix,
 	)
 	finishAt := time.Now().UTC()
-	_, err = svc.dbConn.Exec(query, skip, finishAt, id)
+	_, err = svc.dbConn.Exec(query, skip, processed, spent, lastKey, finishAt, id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+
+	return
+}
+
+// setProgress saves the checkpoint, spent is the budget of the job spent until it,
+// only the running job of this instance is updated: the checkpoint taken before the job was finished
+// must not overwrite the final one saved by finishJob
+func (j *jobs) setProgress(skip, processed, spent int64, lastKey string, id int64) (err error) {
+	query := fmt.Sprintf("UPDATE %sjobs SET skip = $1, processed = $2, spent = $3, last_key = $4 "+
+		" WHERE id = $5 AND owner = $6 AND status IN ('in progress', 'waiting for window')",
+		svc.conf.db.TablePrefix,
+	)
+	_, err = svc.dbConn.Exec(query, skip, processed, spent, lastKey, id, j.conf.InstanceId)
 	if err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
 		return
 	}
+	return
+}
 
+func (j *jobs) setRecovery(id int64, action string) (err error) {
+	query := fmt.Sprintf("UPDATE %sjobs SET recovery = $1, recovered_at = $2 WHERE id = $3",
+		svc.conf.db.TablePrefix,
+	)
+	_, err = svc.dbConn.Exec(query, action, time.Now().UTC(), id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
 	return
 }
 
-func (j *jobs) getExpiredList(p Params) (expired []rec.Record, err error) {
+// getExpiredPage returns up to limit retries with msisdn greater than after, ordered by msisdn,
+// the msisdn is the key of the page as there is one retry per msisdn
+func (j *jobs) getExpiredPage(p Params, after string, limit int) (expired []rec.Record, err error) {
 	begin := time.Now()
 	var query string
 	defer func() {
 		defer func() {
 			fields := log.Fields{
 				"took":  time.Since(begin),
-				"limit": p.Count,
+				"after": after,
+				"limit": limit,
 				"query": query,
 			}
 			if err != nil {
@@ -849,96 +883,10 @@ func (j *jobs) getExpiredList(p Params) (expired []rec.Record, err error) {
 		}()
 	}()
 
-	args := []interface{}{}
-	wheres := []string{}
-	if p.DateFrom != "" {
-		args = append(args, p.DateFrom)
-		wheres = append(wheres, "created_at > %s")
-	}
-	if p.DateTo != "" {
-		args = append(args, p.DateTo)
-		wheres = append(wheres, "created_at < %s")
-	}
-
-	if p.ServiceCode != "" {
-		args = append(args, p.ServiceCode)
-		wheres = append(wheres, "id_service = %s")
-	}
-
-	if p.CampaignId != "" {
-		args = append(args, p.CampaignId)
-		wheres = append(wheres, "id_campaign = %s")
-	}
-
-	if p.Never > 0 {
-		wheres = append(wheres, fmt.Sprintf("msisdn NOT IN ("+
-			" SELECT DISTINCT msisdn "+
-			" FROM %stransactions "+
-			" WHERE ( result = 'paid' OR result = 'retry_paid' OR result = 'injection_paid' OR result = 'expired_paid') )",
-			svc.conf.db.TablePrefix),
-		)
-	}
-
-	if p.LastChargeAt != "" {
-		args = append(args, p.LastChargeAt)
-		wheres = append(wheres, fmt.Sprintf("msisdn NOT IN ("+
-			" SELECT DISTINCT msisdn "+
-			" FROM %stransactions ", svc.conf.db.TablePrefix)+
-			" WHERE ( result = 'paid' OR result = 'retry_paid') AND "+
-			"sent_at > %s ) ",
-		)
-	}
-
-	countWhere := ""
-	if p.Count > 0 {
-		countWhere = fmt.Sprintf(" LIMIT %d", p.Count)
-	}
-
-	whereClauses := []string{}
-	for k, v := range wheres {
-		if strings.Contains(v, "%s") {
-			whereClauses = append(whereClauses, fmt.Sprintf(v, "$"+strconv.Itoa(k+1)))
-		} else {
-			whereClauses = append(whereClauses, v)
-		}
-	}
-
-	where := strings.Join(whereClauses, " AND ")
-	if where != "" {
-		where = "WHERE " + where
-	}
-
-	orderTypeWhere := " ORDER BY msisdn, id ASC "
-	if p.Order != "" {
-		orderTypeWhere = " ORDER BY msisdn, id " + p.Order
+	var args []interface{}
+	if query, args, err = expiredQuery(p, after, limit); err != nil {
+		return
 	}
-	log.WithFields(log.Fields{
-		"args":   fmt.Sprintf("%#v", args),
-		"where":  where + orderTypeWhere + countWhere,
-		"params": p.ToString(),
-	}).Debug("run query")
-
-	query = fmt.Sprintf("SELECT "+
-		"DISTINCT ON (msisdn) msisdn, "+
-		"id, "+
-		"tid, "+
-		"created_at, "+
-		"last_pay_attempt_at, "+
-		"attempts_count, "+
-		"retry_days, "+
-		"delay_hours, "+
-		"price, "+
-		"operator_code, "+
-		"country_code, "+
-		"id_service, "+
-		"id_subscription, "+
-		"id_campaign "+
-		"FROM %sretries_expired "+
-		where+
-		orderTypeWhere+
-		countWhere,
-		svc.conf.db.TablePrefix,
-	)
 
 	var rows *sql.Rows
 	rows, err = svc.jobs.slave.Query(query, args...)
@@ -973,7 +921,7 @@ func (j *jobs) getExpiredList(p Params) (expired []rec.Record, err error) {
 		}
 		expired = append(expired, record)
 	}
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("rows.Error: %s", err.Error())
 		return
@@ -987,7 +935,96 @@ type Rrr struct {
 	Msisdn string
 }
 
-func (j *Job) sendToMobilinkRequests(priority uint8, r rec.Record) (err error) {
+// charge sends the charge request if the msisdn isn't listed or capped and the budget allows,
+// it waits for the rate limits and retries until the request is sent
+func (j *Job) charge(idx int64, r rec.Record, priority uint8) (action string) {
+	operator, err := svc.jobs.operator(r.OperatorCode)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"msisdn": r.Msisdn,
+			"error":  err.Error(),
+		}).Error("cannt charge")
+		return actionError
+	}
+	if !j.ParsedParams.IgnoreLists {
+		listed, err := svc.jobs.listed(r.Msisdn)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"msisdn": r.Msisdn,
+				"error":  err.Error(),
+			}).Error("cannt check lists")
+			return actionError
+		}
+		if listed != "" {
+			return listed
+		}
+	}
+	var attemptAt time.Time
+	if cap := j.frequencyCap(); cap > 0 {
+		now := time.Now().UTC()
+		var ok bool
+		if j.ParsedParams.DryRun {
+			// the dry run doesn't take the attempt from the real jobs
+			ok, err = svc.jobs.attemptFree(r.Msisdn, now, cap)
+		} else {
+			attemptAt = now
+			ok, err = svc.jobs.takeAttempt(r.Msisdn, j.Id, now, cap)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"msisdn": r.Msisdn,
+				"error":  err.Error(),
+			}).Error("cannt check frequency cap")
+			return actionError
+		}
+		if !ok {
+			log.WithFields(log.Fields{
+				"msisdn": r.Msisdn,
+				"hours":  cap.Hours(),
+			}).Info("frequency capped")
+			return actionCapped
+		}
+	}
+	if refused, ok := j.withinBudget(r); !ok {
+		if !attemptAt.IsZero() {
+			if err := svc.jobs.releaseAttempt(r.Msisdn, j.Id, attemptAt); err != nil {
+				log.WithFields(log.Fields{
+					"msisdn": r.Msisdn,
+					"error":  err.Error(),
+				}).Error("cannt release attempt")
+			}
+		}
+		return refused
+	}
+	if !svc.jobs.limits.wait(j, r.OperatorCode) {
+		// the job is stopping, the item is charged on resume
+		j.refundBudget(r)
+		if !attemptAt.IsZero() {
+			if err := svc.jobs.releaseAttempt(r.Msisdn, j.Id, attemptAt); err != nil {
+				log.WithFields(log.Fields{
+					"msisdn": r.Msisdn,
+					"error":  err.Error(),
+				}).Error("cannt release attempt")
+			}
+		}
+		svc.jobs.registry.unsent(j)
+		return actionInterrupted
+	}
+	for {
+		err := j.sendChargeRequest(operator.Requests, priority, r)
+		if err == nil {
+			return actionSent
+		}
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+			"id":    r.RetryId,
+		}).Error("cannt process")
+		j.logMsisdn(idx, r.Msisdn, actionPublishError, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (j *Job) sendChargeRequest(queue string, priority uint8, r rec.Record) (err error) {
 	if j.ParsedParams.DryRun {
 		return nil
 	}
@@ -1000,14 +1037,20 @@ func (j *Job) sendToMobilinkRequests(priority uint8, r rec.Record) (err error) {
 		err = fmt.Errorf("json.Marshal: %s", err.Error())
 		return
 	}
-	svc.publisher.Publish(amqp.AMQPMessage{QueueName: "mobilink_requests", Priority: priority, Body: body})
+	svc.publisher.Publish(amqp.AMQPMessage{QueueName: queue, Priority: priority, Body: body})
 	log.WithFields(log.Fields{
-		"tid": r.Tid,
+		"tid":   r.Tid,
+		"queue": queue,
 	}).Info("sent")
 	return nil
 }
 
+// logMsisdn writes the action in the job log and counts it in the job stats,
+// lines before skip are counted only once, not on every resume
 func (j *Job) logMsisdn(idx int64, msisdn, action string, err error) {
+	if !(action == actionSkip && j.resumed) {
+		svc.jobs.registry.count(j, action)
+	}
 	if msisdn == "" {
 		return
 	}
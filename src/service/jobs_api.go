@@ -0,0 +1,434 @@
+package service
+
+// rest api for jobs: create, read, list, update and delete
+// only "ready" jobs could be updated or deleted
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+var errJobNotReady = errors.New("Job is not ready")
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// JobRequest is the body of POST /jobs and PATCH /jobs/id/:id,
+// for PATCH only run_at and params are used
+type JobRequest struct {
+	UserId   int64           `json:"user_id"`
+	RunAt    *time.Time      `json:"run_at,omitempty"`
+	Type     string          `json:"type"`
+	FileName string          `json:"file_name,omitempty"`
+	Skip     int64           `json:"skip,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+}
+
+func (j *jobs) create(c *gin.Context) {
+	var req JobRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	j.createJob(c, req)
+}
+
+func (j *jobs) createJob(c *gin.Context, req JobRequest) {
+	job, err := newJob(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	id, err := j.insert(job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":   id,
+		"type": job.Type,
+	}).Info("created")
+	j.wakeScheduler()
+	j.respondJob(c, http.StatusCreated, id)
+}
+
+// newJob makes the "ready" job of the request
+func newJob(req JobRequest) (Job, error) {
+	job := Job{
+		UserId:   req.UserId,
+		RunAt:    time.Now().UTC(),
+		Type:     req.Type,
+		Status:   "ready",
+		FileName: req.FileName,
+		Skip:     req.Skip,
+		Params:   "{}",
+	}
+	if req.RunAt != nil {
+		job.RunAt = req.RunAt.UTC()
+	}
+	if len(req.Params) > 0 {
+		job.Params = string(req.Params)
+	}
+	err := job.validate()
+	return job, err
+}
+
+func (j *jobs) read(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	j.respondJob(c, http.StatusOK, id)
+}
+
+// list?status=ready&type=injection&user_id=1&date_from=2017-08-01&date_to=2017-09-01&limit=100&offset=0
+func (j *jobs) list(c *gin.Context) {
+	f := JobsFilter{
+		Status: c.Query("status"),
+		Type:   c.Query("type"),
+		Limit:  100,
+	}
+	var err error
+	if v := c.Query("user_id"); v != "" {
+		if f.UserId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("user_id: %s", err.Error()),
+			})
+			return
+		}
+	}
+	if v := c.Query("date_from"); v != "" {
+		if f.DateFrom, err = parseDate(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("date_from: %s", err.Error()),
+			})
+			return
+		}
+	}
+	if v := c.Query("date_to"); v != "" {
+		if f.DateTo, err = parseDate(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("date_to: %s", err.Error()),
+			})
+			return
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be from 1 to 1000",
+			})
+			return
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "offset must be positive",
+			})
+			return
+		}
+	}
+
+	jobs, err := j.getList(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if jobs == nil {
+		jobs = []Job{}
+	}
+	for i := range jobs {
+		json.Unmarshal([]byte(jobs[i].Params), &jobs[i].ParsedParams)
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+func (j *jobs) update(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	var req JobRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	job, err := j.get(id)
+	if err != nil {
+		j.respondError(c, err)
+		return
+	}
+	if job.Status != "ready" {
+		j.respondError(c, errJobNotReady)
+		return
+	}
+	if req.RunAt != nil {
+		job.RunAt = req.RunAt.UTC()
+	}
+	if len(req.Params) > 0 {
+		job.Params = string(req.Params)
+	}
+	if err := job.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := j.updateReady(id, job.RunAt, job.Params); err != nil {
+		j.respondError(c, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":     id,
+		"run_at": job.RunAt,
+		"params": job.Params,
+	}).Info("updated")
+	j.wakeScheduler()
+	j.respondJob(c, http.StatusOK, id)
+}
+
+func (j *jobs) remove(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	if err := j.deleteReady(id); err != nil {
+		j.respondError(c, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Info("deleted")
+	c.JSON(http.StatusOK, struct{}{})
+}
+
+// respondJob returns the job with its stats, live ones if the job is running
+func (j *jobs) respondJob(c *gin.Context, code int, id int64) {
+	job, err := j.get(id)
+	if err != nil {
+		j.respondError(c, err)
+		return
+	}
+	json.Unmarshal([]byte(job.Params), &job.ParsedParams)
+	if stats, ok := j.registry.stats(id); ok {
+		job.Stats = stats
+	} else if job.Stats, err = j.getStats(id); err != nil {
+		j.respondError(c, err)
+		return
+	}
+	c.JSON(code, job)
+}
+
+func (j *jobs) respondError(c *gin.Context, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case errJobNotFound, errTemplateNotFound:
+		code = http.StatusNotFound
+	case errJobNotReady, errTemplateChanged:
+		code = http.StatusConflict
+	}
+	c.JSON(code, gin.H{
+		"error": err.Error(),
+	})
+}
+
+// validate checks the job before it is saved, so the wrong job fails here and not on start
+func (job *Job) validate() error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(job.Params)))
+	decoder.DisallowUnknownFields()
+	var p Params
+	if err := decoder.Decode(&p); err != nil {
+		return fmt.Errorf("params: %s", err.Error())
+	}
+	job.ParsedParams = p
+
+	if job.Skip < 0 {
+		return fmt.Errorf("skip must be positive: %d", job.Skip)
+	}
+	if p.Count < 0 {
+		return fmt.Errorf("count must be positive: %d", p.Count)
+	}
+	if p.Never < 0 {
+		return fmt.Errorf("never must be positive: %d", p.Never)
+	}
+	for name, v := range map[string]string{
+		"date_from":             p.DateFrom,
+		"date_to":               p.DateTo,
+		"last_charge_at":        p.LastChargeAt,
+		"last_pay_attempt_from": p.LastPayAttemptFrom,
+		"last_pay_attempt_to":   p.LastPayAttemptTo,
+	} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseDate(v); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	switch strings.ToLower(p.Order) {
+	case "", "asc", "desc":
+	default:
+		return fmt.Errorf("order must be asc or desc: %s", p.Order)
+	}
+	switch p.Missed {
+	case "", missedRunNow, missedSkip:
+	case missedGrace:
+		if p.GraceMinutes <= 0 {
+			return fmt.Errorf("grace_minutes required for missed %s", missedGrace)
+		}
+	default:
+		return fmt.Errorf("missed must be %s, %s or %s: %s", missedRunNow, missedSkip, missedGrace, p.Missed)
+	}
+	if _, err := jobWindow(config.CalendarConfig{}, config.OperatorConfig{}, p); err != nil {
+		return fmt.Errorf("window: %s", err.Error())
+	}
+	if p.FrequencyCapHours < 0 {
+		return fmt.Errorf("frequency_cap_hours must be positive: %d", p.FrequencyCapHours)
+	}
+	if p.Budget < 0 {
+		return fmt.Errorf("budget must be positive: %d", p.Budget)
+	}
+	if p.MaxPerDay < 0 {
+		return fmt.Errorf("max_per_day must be positive: %d", p.MaxPerDay)
+	}
+	if p.Rate < 0 {
+		return fmt.Errorf("rate must be positive: %v", p.Rate)
+	}
+	if p.RampUpSeconds < 0 {
+		return fmt.Errorf("ramp_up_seconds must be positive: %d", p.RampUpSeconds)
+	}
+	if p.GraceMinutes < 0 {
+		return fmt.Errorf("grace_minutes must be positive: %d", p.GraceMinutes)
+	}
+	if p.OperatorCode != 0 {
+		if _, err := svc.jobs.operator(p.OperatorCode); err != nil {
+			return fmt.Errorf("operator_code: %s", err.Error())
+		}
+	}
+	if p.AttemptsFrom < 0 || p.AttemptsTo < 0 {
+		return fmt.Errorf("attempts_from and attempts_to must be positive: %d, %d", p.AttemptsFrom, p.AttemptsTo)
+	}
+	for _, id := range p.SubscriptionIds {
+		if id <= 0 {
+			return fmt.Errorf("subscription_ids must be positive: %d", id)
+		}
+	}
+
+	runner, err := newRunner(job.Type)
+	if err != nil {
+		return err
+	}
+	return runner.Validate(job)
+}
+
+func parseDate(s string) (t time.Time, err error) {
+	for _, layout := range dateLayouts {
+		if t, err = time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+	err = fmt.Errorf("cannot parse date: %s", s)
+	return
+}
+
+func (j *jobs) insert(job Job) (id int64, err error) {
+	query := fmt.Sprintf("INSERT INTO %sjobs ("+
+		"id_user, "+
+		"run_at, "+
+		"status, "+
+		"type, "+
+		"file_name, "+
+		"params, "+
+		"skip "+
+		") VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query,
+		job.UserId,
+		job.RunAt,
+		job.Status,
+		job.Type,
+		job.FileName,
+		job.Params,
+		job.Skip,
+	).Scan(&id); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+// updateReady doesn't touch the job if it has been started meanwhile
+func (j *jobs) updateReady(id int64, runAt time.Time, params string) (err error) {
+	query := fmt.Sprintf("UPDATE %sjobs SET run_at = $1, params = $2 "+
+		" WHERE id = $3 AND status = 'ready'",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := svc.dbConn.Exec(query, runAt, params, id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errJobNotReady
+	}
+	return
+}
+
+func (j *jobs) deleteReady(id int64) (err error) {
+	if _, err = j.get(id); err != nil {
+		return
+	}
+	query := fmt.Sprintf("DELETE FROM %sjobs WHERE id = $1 AND status = 'ready'",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := svc.dbConn.Exec(query, id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errJobNotReady
+	}
+	return
+}
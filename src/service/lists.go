@@ -0,0 +1,215 @@
+package service
+
+// msisdn_blacklist and msisdn_postpaid are never charged by jobs,
+// both tables are kept in memory and reloaded every jobs.lists_refresh_seconds.
+// until the first load the msisdn is checked in the db directly.
+// params.ignore_lists turns the check off, for the test numbers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	actionBlacklisted = "blacklisted"
+	actionPostpaid    = "postpaid"
+)
+
+type msisdnList struct {
+	name   string // in the api and in params.list
+	action string
+	table  string
+}
+
+// listTables maps the action to the table the msisdn is looked up in
+var listTables = []msisdnList{
+	{"blacklist", actionBlacklisted, "msisdn_blacklist"},
+	{"postpaid", actionPostpaid, "msisdn_postpaid"},
+}
+
+var errUnknownList = errors.New("Unknown list, expected blacklist or postpaid")
+
+func getMsisdnList(name string) (msisdnList, error) {
+	for _, l := range listTables {
+		if l.name == name {
+			return l, nil
+		}
+	}
+	return msisdnList{}, errUnknownList
+}
+
+type msisdnLists struct {
+	sync.RWMutex
+	loaded  bool
+	msisdns map[string]map[string]struct{} // action: msisdns
+}
+
+func newMsisdnLists() *msisdnLists {
+	return &msisdnLists{
+		msisdns: make(map[string]map[string]struct{}),
+	}
+}
+
+// refreshLists reloads the lists periodically
+func (j *jobs) refreshLists() {
+	j.loadLists()
+	if j.conf.ListsRefreshSeconds <= 0 {
+		return
+	}
+	for range time.Tick(time.Duration(j.conf.ListsRefreshSeconds) * time.Second) {
+		j.loadLists()
+	}
+}
+
+func (j *jobs) loadLists() {
+	begin := time.Now()
+	msisdns := make(map[string]map[string]struct{})
+	for _, l := range listTables {
+		set, err := j.getMsisdnList(l.table)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"table": l.table,
+				"error": err.Error(),
+			}).Error("cannt load list")
+			return
+		}
+		msisdns[l.action] = set
+	}
+
+	j.lists.Lock()
+	j.lists.msisdns = msisdns
+	j.lists.loaded = true
+	j.lists.Unlock()
+	log.WithFields(log.Fields{
+		"blacklisted": len(msisdns[actionBlacklisted]),
+		"postpaid":    len(msisdns[actionPostpaid]),
+		"took":        time.Since(begin),
+	}).Info("lists loaded")
+}
+
+func (j *jobs) getMsisdnList(table string) (set map[string]struct{}, err error) {
+	query := fmt.Sprintf("SELECT msisdn FROM %s%s", svc.conf.db.TablePrefix, table)
+	var rows *sql.Rows
+	rows, err = svc.dbConn.Query(query)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	set = make(map[string]struct{})
+	for rows.Next() {
+		var msisdn string
+		if err = rows.Scan(&msisdn); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		set[msisdn] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	return
+}
+
+// listed returns the action if the msisdn is in one of the lists, empty string otherwise
+func (j *jobs) listed(msisdn string) (action string, err error) {
+	j.lists.RLock()
+	loaded := j.lists.loaded
+	for _, l := range listTables {
+		if _, ok := j.lists.msisdns[l.action][msisdn]; ok {
+			action = l.action
+			break
+		}
+	}
+	j.lists.RUnlock()
+	if loaded {
+		return
+	}
+
+	for _, l := range listTables {
+		ok, err := j.inList(l, msisdn)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return l.action, nil
+		}
+	}
+	return "", nil
+}
+
+// setListed updates the snapshot right after the list is changed,
+// so the jobs don't wait for the next refresh
+func (ls *msisdnLists) setListed(action, msisdn string, listed bool) {
+	ls.Lock()
+	defer ls.Unlock()
+	if !ls.loaded {
+		return
+	}
+	set, ok := ls.msisdns[action]
+	if !ok {
+		set = make(map[string]struct{})
+		ls.msisdns[action] = set
+	}
+	if listed {
+		set[msisdn] = struct{}{}
+	} else {
+		delete(set, msisdn)
+	}
+}
+
+// addListed adds the msisdn to the list, false if it is there already
+func (j *jobs) addListed(l msisdnList, msisdn string) (added bool, err error) {
+	query := fmt.Sprintf("INSERT INTO %s%s (msisdn) "+
+		" SELECT $1 WHERE NOT EXISTS (SELECT 1 FROM %s%s WHERE msisdn = $1)",
+		svc.conf.db.TablePrefix, l.table, svc.conf.db.TablePrefix, l.table,
+	)
+	res, err := svc.dbConn.Exec(query, msisdn)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	j.lists.setListed(l.action, msisdn, true)
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// removeListed removes the msisdn from the list, false if it wasn't there
+func (j *jobs) removeListed(l msisdnList, msisdn string) (removed bool, err error) {
+	query := fmt.Sprintf("DELETE FROM %s%s WHERE msisdn = $1", svc.conf.db.TablePrefix, l.table)
+	res, err := svc.dbConn.Exec(query, msisdn)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	j.lists.setListed(l.action, msisdn, false)
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// inList looks the msisdn up in the db, not in the snapshot
+func (j *jobs) inList(l msisdnList, msisdn string) (listed bool, err error) {
+	query := fmt.Sprintf("SELECT 1 FROM %s%s WHERE msisdn = $1 LIMIT 1", svc.conf.db.TablePrefix, l.table)
+	var one int
+	if err = svc.dbConn.QueryRow(query, msisdn).Scan(&one); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return true, nil
+}
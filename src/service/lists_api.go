@@ -0,0 +1,203 @@
+package service
+
+// rest api for msisdn_blacklist and msisdn_postpaid, :list is blacklist or postpaid:
+// POST /lists/:list {"msisdns": [...]} adds, GET and DELETE /lists/:list/:msisdn look up and remove,
+// POST /lists/:list/import creates the list_import job for the csv file in injections_path
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListRequest is the body of POST /lists/:list
+type ListRequest struct {
+	Msisdns []string `json:"msisdns"`
+}
+
+// ListImportRequest is the body of POST /lists/:list/import
+type ListImportRequest struct {
+	UserId   int64      `json:"user_id"`
+	FileName string     `json:"file_name"`
+	RunAt    *time.Time `json:"run_at,omitempty"`
+}
+
+func (j *jobs) bindList(c *gin.Context) (l msisdnList, ok bool) {
+	l, err := getMsisdnList(c.Param("list"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return l, false
+	}
+	return l, true
+}
+
+func (j *jobs) addToList(c *gin.Context) {
+	l, ok := j.bindList(c)
+	if !ok {
+		return
+	}
+	var req ListRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(req.Msisdns) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "msisdns required",
+		})
+		return
+	}
+
+	added, listed := []string{}, []string{}
+	rejected := make(map[string]string)
+	for _, orig := range req.Msisdns {
+		msisdn, err := j.normalizeAny(orig)
+		if err != nil {
+			rejected[orig] = err.Error()
+			continue
+		}
+		ok, err := j.addListed(l, msisdn)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if ok {
+			added = append(added, msisdn)
+		} else {
+			listed = append(listed, msisdn)
+		}
+	}
+	log.WithFields(log.Fields{
+		"list":     l.name,
+		"added":    len(added),
+		"rejected": len(rejected),
+	}).Info("added to list")
+	c.JSON(http.StatusOK, gin.H{
+		"added":          added,
+		"already_listed": listed,
+		"rejected":       rejected,
+	})
+}
+
+func (j *jobs) lookupList(c *gin.Context) {
+	l, ok := j.bindList(c)
+	if !ok {
+		return
+	}
+	msisdn, err := j.normalizeAny(c.Param("msisdn"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	listed, err := j.inList(l, msisdn)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !listed {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Not in %s: %s", l.name, msisdn),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"list":   l.name,
+		"msisdn": msisdn,
+	})
+}
+
+func (j *jobs) removeFromList(c *gin.Context) {
+	l, ok := j.bindList(c)
+	if !ok {
+		return
+	}
+	msisdn, err := j.normalizeAny(c.Param("msisdn"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	removed, err := j.removeListed(l, msisdn)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Not in %s: %s", l.name, msisdn),
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"list":   l.name,
+		"msisdn": msisdn,
+	}).Info("removed from list")
+	c.JSON(http.StatusOK, struct{}{})
+}
+
+// importList is the shortcut for POST /jobs with type list_import
+func (j *jobs) importList(c *gin.Context) {
+	l, ok := j.bindList(c)
+	if !ok {
+		return
+	}
+	var req ListImportRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	params, _ := json.Marshal(Params{List: l.name})
+	j.createJob(c, JobRequest{
+		UserId:   req.UserId,
+		RunAt:    req.RunAt,
+		Type:     "list_import",
+		FileName: req.FileName,
+		Params:   params,
+	})
+}
+
+// report downloads the rejected lines of the list_import job
+func (j *jobs) report(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	job, err := j.get(id)
+	if err != nil {
+		j.respondError(c, err)
+		return
+	}
+	path := reportPath(job.Id)
+	if _, err := os.Stat(path); job.Type != "list_import" || err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("No report of job %d", job.Id),
+		})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=jobs_%d_rejected.csv", job.Id))
+	c.File(path)
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListed(t *testing.T) {
+	j := &jobs{lists: newMsisdnLists()}
+	j.lists.loaded = true
+	j.lists.msisdns[actionBlacklisted] = map[string]struct{}{"923001112233": {}}
+	j.lists.msisdns[actionPostpaid] = map[string]struct{}{"923004445566": {}}
+
+	action, err := j.listed("923001112233")
+	assert.NoError(t, err)
+	assert.Equal(t, actionBlacklisted, action, "blacklisted")
+
+	action, err = j.listed("923004445566")
+	assert.NoError(t, err)
+	assert.Equal(t, actionPostpaid, action, "postpaid")
+
+	action, err = j.listed("923007778899")
+	assert.NoError(t, err)
+	assert.Equal(t, "", action, "not listed")
+}
+
+func TestSetListed(t *testing.T) {
+	j := &jobs{lists: newMsisdnLists()}
+	j.lists.setListed(actionBlacklisted, "923001112233", true)
+	assert.Empty(t, j.lists.msisdns, "not loaded yet, the db is checked")
+
+	j.lists.loaded = true
+	j.lists.setListed(actionBlacklisted, "923001112233", true)
+	action, err := j.listed("923001112233")
+	assert.NoError(t, err)
+	assert.Equal(t, actionBlacklisted, action, "added")
+
+	j.lists.setListed(actionBlacklisted, "923001112233", false)
+	action, err = j.listed("923001112233")
+	assert.NoError(t, err)
+	assert.Equal(t, "", action, "removed")
+
+	l, err := getMsisdnList("postpaid")
+	assert.NoError(t, err)
+	assert.Equal(t, actionPostpaid, l.action)
+	_, err = getMsisdnList("whitelist")
+	assert.Equal(t, errUnknownList, err)
+}
@@ -19,13 +19,14 @@ type suspendedSubscriptions struct {
 }
 
 type SuspendedSubscrptionsParams struct {
-	Limit int
-	Hours int
+	Limit        int
+	Hours        int
+	OperatorCode int64
 }
 
 // does simple thing:
 // selects all subscriptions form database with result = '' and before hours
-// and pushes to queue
+// and pushes to tarifficate queue of the operator, ?operator=41001, jobs.default_operator by default
 func AddSubscriptionsHandler(r *gin.Engine) {
 	rg := r.Group("/api")
 	rg.GET("", svc.suspendedSubscriptions.Call)
@@ -46,9 +47,18 @@ func (ss *suspendedSubscriptions) Call(c *gin.Context) {
 		hours = 1
 	}
 
+	operatorCode := svc.jobs.conf.DefaultOperator
+	if operatorStr, ok := c.GetQuery("operator"); ok {
+		if operatorCode, err = strconv.ParseInt(operatorStr, 10, 64); err != nil {
+			c.JSON(400, fmt.Sprintf("operator: %s", err.Error()))
+			return
+		}
+	}
+
 	params := SuspendedSubscrptionsParams{
-		Limit: limit,
-		Hours: hours,
+		Limit:        limit,
+		Hours:        hours,
+		OperatorCode: operatorCode,
 	}
 
 	count, err := ss.process(params)
@@ -69,18 +79,29 @@ func (ss *suspendedSubscriptions) process(p SuspendedSubscrptionsParams) (count
 		}).Debug("get notpaid subscriptions")
 	}()
 
-	records, err := ss.get(41001, p.Hours, p.Limit)
+	operator, err := svc.jobs.operator(p.OperatorCode)
+	if err != nil {
+		return
+	}
+	if operator.Tarifficate == "" {
+		err = fmt.Errorf("no tarifficate queue of operator %d", p.OperatorCode)
+		return
+	}
+
+	records, err := ss.get(p.OperatorCode, p.Hours, p.Limit)
 	if err != nil {
 		err = fmt.Errorf("rec.GetSuspendedSubscriptions: %s", err.Error())
 		return
 	}
 	count = len(records)
 
+	// http server shutdown waits for the handler, so all messages are published before exit
 	wg := &sync.WaitGroup{}
 	for _, r := range records {
 		wg.Add(1)
-		go func() {
-			if err = ss.sendTarifficate(r); err != nil {
+		go func(r rec.Record) {
+			defer wg.Done()
+			if err := ss.sendTarifficate(operator.Tarifficate, r); err != nil {
 				NotifyErrors.Inc()
 
 				log.WithFields(log.Fields{
@@ -88,10 +109,8 @@ func (ss *suspendedSubscriptions) process(p SuspendedSubscrptionsParams) (count
 					"error": err.Error(),
 					"msg":   "dropped",
 				}).Error("sent tarificate  error")
-				return
 			}
-			wg.Done()
-		}()
+		}(r)
 	}
 	wg.Wait()
 	return
@@ -163,8 +182,7 @@ func (ss *suspendedSubscriptions) get(operatorCode int64, hours, limit int) (rec
 	}
 	return
 }
-func (ss *suspendedSubscriptions) sendTarifficate(r rec.Record) error {
-	queue := "mobilink_mo_tarifficate"
+func (ss *suspendedSubscriptions) sendTarifficate(queue string, r rec.Record) error {
 	event := amqp.EventNotify{
 		EventName: "charge",
 		EventData: r,
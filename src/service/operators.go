@@ -0,0 +1,97 @@
+package service
+
+// operators the jobs charge, from jobs.operators:
+// the record gets the country code of the operator and is published to its queues,
+// the msisdn is normalized by the rules of the country and must start with one of the operator prefixes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/linkit360/go-jobs/src/config"
+	"github.com/linkit360/go-jobs/src/msisdn"
+)
+
+var errUnknownOperator = errors.New("Unknown operator")
+
+// initOperators falls back to mobilink for the configs without operators
+func initOperators(conf *config.JobsConfig) error {
+	if len(conf.Operators) == 0 {
+		conf.Operators = map[int64]config.OperatorConfig{
+			conf.DefaultOperator: {
+				Name:        "mobilink",
+				CountryCode: 92,
+				Prefixes:    []string{conf.CheckPrefix},
+				Requests:    "mobilink_requests",
+				Tarifficate: "mobilink_mo_tarifficate",
+			},
+		}
+	}
+	if _, ok := conf.Operators[conf.DefaultOperator]; !ok {
+		return fmt.Errorf("default_operator %d is not in operators", conf.DefaultOperator)
+	}
+	for code, o := range conf.Operators {
+		if o.Requests == "" {
+			return fmt.Errorf("operator %d: requests queue required", code)
+		}
+		if len(o.Prefixes) == 0 {
+			return fmt.Errorf("operator %d: prefixes required", code)
+		}
+		if _, err := time.LoadLocation(o.Timezone); err != nil {
+			return fmt.Errorf("operator %d: timezone: %s", code, err.Error())
+		}
+	}
+	return nil
+}
+
+// operator returns the config of the operator code
+func (j *jobs) operator(code int64) (config.OperatorConfig, error) {
+	o, ok := j.conf.Operators[code]
+	if !ok {
+		return o, fmt.Errorf("%s: %d", errUnknownOperator.Error(), code)
+	}
+	return o, nil
+}
+
+// jobOperator is params.operator_code or jobs.default_operator
+func (j *jobs) jobOperator(p Params) (int64, config.OperatorConfig, error) {
+	code := j.conf.DefaultOperator
+	if p.OperatorCode != 0 {
+		code = p.OperatorCode
+	}
+	o, err := j.operator(code)
+	return code, o, err
+}
+
+// operatorRules are the rules of the operator country limited to the operator prefixes
+func operatorRules(o config.OperatorConfig) msisdn.Rules {
+	rs := msisdn.ForCountry(strconv.FormatInt(o.CountryCode, 10))
+	rs.Ranges = o.Prefixes
+	return rs
+}
+
+// normalizeAny normalizes the msisdn of any operator, the lists are shared by them,
+// the rejection is the one of the default operator
+func (j *jobs) normalizeAny(orig string) (string, error) {
+	codes := []int64{}
+	for code := range j.conf.Operators {
+		if code != j.conf.DefaultOperator {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(a, b int) bool { return codes[a] < codes[b] })
+
+	msisdn, rejected := operatorRules(j.conf.Operators[j.conf.DefaultOperator]).Normalize(orig)
+	if rejected == nil {
+		return msisdn, nil
+	}
+	for _, code := range codes {
+		if msisdn, err := operatorRules(j.conf.Operators[code]).Normalize(orig); err == nil {
+			return msisdn, nil
+		}
+	}
+	return "", rejected
+}
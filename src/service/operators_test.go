@@ -0,0 +1,52 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+	"github.com/linkit360/go-jobs/src/msisdn"
+)
+
+func TestInitOperators(t *testing.T) {
+	conf := config.JobsConfig{CheckPrefix: "92", DefaultOperator: 41001}
+	assert.NoError(t, initOperators(&conf), "mobilink by default")
+	assert.Equal(t, "mobilink_requests", conf.Operators[41001].Requests)
+
+	j := &jobs{conf: conf}
+	code, o, err := j.jobOperator(Params{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(41001), code, "default operator")
+	assert.Equal(t, int64(92), o.CountryCode)
+
+	_, _, err = j.jobOperator(Params{OperatorCode: 25099})
+	assert.Error(t, err, "not configured")
+
+	conf = config.JobsConfig{DefaultOperator: 41001, Operators: map[int64]config.OperatorConfig{
+		25099: {Name: "beeline", Prefixes: []string{"79"}, Requests: "beeline_requests"},
+	}}
+	assert.Error(t, initOperators(&conf), "default operator is not configured")
+
+	conf.DefaultOperator = 25099
+	assert.NoError(t, initOperators(&conf))
+}
+
+func TestNormalizeAny(t *testing.T) {
+	j := &jobs{conf: config.JobsConfig{DefaultOperator: 41001, Operators: map[int64]config.OperatorConfig{
+		41001: {CountryCode: 92, Prefixes: []string{"9230"}, Requests: "mobilink_requests"},
+		25099: {CountryCode: 7, Prefixes: []string{"79"}, Requests: "beeline_requests"},
+	}}}
+	m, err := j.normalizeAny("03001112233")
+	assert.NoError(t, err)
+	assert.Equal(t, "923001112233", m, "default operator")
+
+	m, err = j.normalizeAny("+7 916 111-22-33")
+	assert.NoError(t, err)
+	assert.Equal(t, "79161112233", m, "other operator")
+
+	_, err = j.normalizeAny("03451112233")
+	if assert.IsType(t, &msisdn.Error{}, err) {
+		assert.Equal(t, msisdn.ReasonOperator, err.(*msisdn.Error).Reason, "rejection of the default operator")
+	}
+}
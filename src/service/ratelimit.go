@@ -0,0 +1,182 @@
+package service
+
+// rate limits of publishing the charge requests, in messages per second:
+// - per job: params.rate or jobs.rate_limit, ramped up from the start of the job
+// - per operator: jobs.operator_rate_limits, shared by all running jobs
+// - global: jobs.global_rate_limit, shared by all running jobs
+// every message waits for the slot in all limits it is under
+
+import (
+	"sync"
+	"time"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+// limiter spreads the messages evenly, rate 0 is unlimited
+type limiter struct {
+	sync.Mutex
+	rate float64
+	next time.Time // the next message is not sent before
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate}
+}
+
+func (l *limiter) getRate() float64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.rate
+}
+
+// reserve returns the time the message could be sent at according to all limiters,
+// the limiters must always be given in the same order: job, operator, global
+func reserve(now time.Time, limiters ...*limiter) time.Time {
+	for _, l := range limiters {
+		l.Lock()
+		defer l.Unlock()
+	}
+	at := now
+	for _, l := range limiters {
+		if l.next.After(at) {
+			at = l.next
+		}
+	}
+	for _, l := range limiters {
+		if l.rate > 0 {
+			l.next = at.Add(time.Duration(float64(time.Second) / l.rate))
+		}
+	}
+	return at
+}
+
+// cancel returns the slot reserved at at, unless the next message has reserved the slot after it
+func cancel(at time.Time, limiters ...*limiter) {
+	for _, l := range limiters {
+		l.Lock()
+		defer l.Unlock()
+	}
+	for _, l := range limiters {
+		if l.rate > 0 && l.next.Equal(at.Add(time.Duration(float64(time.Second)/l.rate))) {
+			l.next = at
+		}
+	}
+}
+
+type limits struct {
+	sync.Mutex
+	conf      config.JobsConfig
+	global    *limiter
+	operators map[int64]*limiter
+}
+
+func newLimits(conf config.JobsConfig) *limits {
+	return &limits{
+		conf:      conf,
+		global:    newLimiter(conf.GlobalRateLimit),
+		operators: make(map[int64]*limiter),
+	}
+}
+
+func (ls *limits) operator(code int64) *limiter {
+	ls.Lock()
+	defer ls.Unlock()
+	l, ok := ls.operators[code]
+	if !ok {
+		l = newLimiter(ls.conf.OperatorRateLimits[code])
+		ls.operators[code] = l
+	}
+	return l
+}
+
+// rate is the limit of the job in messages per second, 0 is unlimited
+func (ls *limits) rate(p Params) float64 {
+	if p.Rate > 0 {
+		return p.Rate
+	}
+	return ls.conf.RateLimit
+}
+
+// rateAt is the ramped up limit of the job after it has run for elapsed,
+// it grows linearly from the tenth of the rate
+func (ls *limits) rateAt(p Params, elapsed time.Duration) float64 {
+	rate := ls.rate(p)
+	rampUp := time.Duration(ls.conf.RampUpSeconds) * time.Second
+	if p.RampUpSeconds > 0 {
+		rampUp = time.Duration(p.RampUpSeconds) * time.Second
+	}
+	if rate <= 0 || rampUp <= 0 || elapsed >= rampUp {
+		return rate
+	}
+	from := rate / 10
+	return from + (rate-from)*float64(elapsed)/float64(rampUp)
+}
+
+// wait blocks until the job could send the message to the operator,
+// false if the job was asked to stop meanwhile, the reserved slot is returned then
+func (ls *limits) wait(j *Job, operatorCode int64) bool {
+	now := time.Now()
+	j.limiter.update(ls.rateAt(j.ParsedParams, now.Sub(j.limiter.startedAt)), operatorCode)
+
+	limiters := []*limiter{j.limiter.limiter, ls.operator(operatorCode), ls.global}
+	at := reserve(now, limiters...)
+	if !at.After(now) {
+		return true
+	}
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-j.interrupt:
+		cancel(at, limiters...)
+		return false
+	}
+}
+
+// effective is the lowest of the limits the job is under now, 0 is unlimited
+func (ls *limits) effective(j Job) float64 {
+	if j.limiter == nil {
+		return 0
+	}
+	_, operatorCode := j.limiter.current()
+	rate := ls.rateAt(j.ParsedParams, time.Since(j.limiter.startedAt))
+	limiters := []*limiter{ls.global}
+	if operatorCode != 0 {
+		limiters = append(limiters, ls.operator(operatorCode))
+	}
+	for _, l := range limiters {
+		if r := l.getRate(); r > 0 && (rate <= 0 || r < rate) {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// jobLimiter is the limiter of the job, it remembers the operator charged last
+type jobLimiter struct {
+	*limiter
+	startedAt time.Time // the ramp up is counted from
+	operator  int64
+}
+
+func newJobLimiter() *jobLimiter {
+	return &jobLimiter{
+		limiter:   newLimiter(0),
+		startedAt: time.Now(),
+	}
+}
+
+func (l *jobLimiter) update(rate float64, operatorCode int64) {
+	l.Lock()
+	l.rate = rate
+	l.operator = operatorCode
+	l.Unlock()
+}
+
+func (l *jobLimiter) current() (float64, int64) {
+	l.Lock()
+	defer l.Unlock()
+	return l.rate, l.operator
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+func TestRateAt(t *testing.T) {
+	ls := newLimits(config.JobsConfig{RateLimit: 10, RampUpSeconds: 100})
+
+	assert.Equal(t, float64(1), ls.rateAt(Params{}, 0), "starts from the tenth")
+	assert.Equal(t, 5.5, ls.rateAt(Params{}, 50*time.Second), "linear")
+	assert.Equal(t, float64(10), ls.rateAt(Params{}, 100*time.Second), "ramped up")
+	assert.Equal(t, float64(20), ls.rateAt(Params{Rate: 20, RampUpSeconds: 10}, time.Minute), "params")
+	assert.Equal(t, float64(0), newLimits(config.JobsConfig{}).rateAt(Params{}, 0), "unlimited")
+}
+
+func TestReserve(t *testing.T) {
+	now := time.Now()
+	job, global := newLimiter(10), newLimiter(2)
+	unlimited := newLimiter(0)
+
+	assert.Equal(t, now, reserve(now, job, unlimited, global), "first is sent at once")
+	assert.Equal(t, now.Add(500*time.Millisecond), reserve(now, job, unlimited, global), "the lowest rate wins")
+	assert.Equal(t, now.Add(time.Second), reserve(now, newLimiter(10), unlimited, global), "global is shared")
+	assert.Equal(t, now, reserve(now, unlimited), "unlimited")
+}
+
+func TestEffectiveRate(t *testing.T) {
+	ls := newLimits(config.JobsConfig{
+		RateLimit:          50,
+		GlobalRateLimit:    100,
+		OperatorRateLimits: map[int64]float64{41001: 20},
+	})
+	job := Job{limiter: newJobLimiter()}
+	assert.Equal(t, float64(0), ls.effective(Job{}), "not started")
+	assert.Equal(t, float64(50), ls.effective(job), "job limit")
+
+	job.limiter.update(50, 41001)
+	assert.Equal(t, float64(20), ls.effective(job), "operator limit")
+}
+
+func TestWaitInterrupted(t *testing.T) {
+	ls := newLimits(config.JobsConfig{GlobalRateLimit: 0.1})
+	job := &Job{limiter: newJobLimiter(), interrupt: make(chan struct{})}
+	assert.True(t, ls.wait(job, 41001), "first is sent at once")
+
+	next := ls.global.next
+	close(job.interrupt)
+	begin := time.Now()
+	assert.False(t, ls.wait(job, 41001), "interrupted")
+	assert.True(t, time.Since(begin) < time.Second, "doesn't sleep")
+	assert.Equal(t, next, ls.global.next, "the slot is returned")
+}
@@ -0,0 +1,91 @@
+package service
+
+// jobs left "in progress" after crash or restart of the service
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpoints periodically saves the progress of the running jobs,
+// so after the crash we know where every job has stopped
+func (j *jobs) checkpoints() {
+	for range time.Tick(time.Duration(j.conf.CheckpointPeriodSeconds) * time.Second) {
+		for _, job := range j.registry.snapshot() {
+			if job.finished {
+				continue
+			}
+			if err := j.setProgress(job.checkpoint(), job.Processed, job.Spent, job.LastKey, job.Id); err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("checkpoint")
+			}
+			j.flushStats(job)
+		}
+	}
+}
+
+// recoverJobs is called once on start, when nothing is running yet,
+// so every own job with status "in progress" was orphaned by the previous run,
+// the jobs of other instances are orphaned when their claims are stale:
+// - nothing processed according to the last checkpoint: requeued as "ready"
+// - has progress and recover_resume enabled: resumed from the checkpoint
+// - otherwise: marked as "interrupted", it could be resumed by hand
+// the jobs "interrupted" by the graceful shutdown are resumed if recover_resume enabled
+// the taken action is written in recovery column
+func (j *jobs) recoverJobs() {
+	if j.conf.RecoverResume {
+		interrupted, err := j.getList(JobsFilter{Status: "interrupted"})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("cannot recover interrupted jobs")
+		}
+		for _, job := range interrupted {
+			if err := j.resumeJob(job.Id); err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("resume interrupted failed")
+				continue
+			}
+			if err := j.setRecovery(job.Id, "resumed"); err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("set recovery")
+			}
+		}
+	}
+
+	j.reclaimStale(true)
+}
+
+func (j *jobs) recoverJob(job Job, action string) (err error) {
+	switch action {
+	case "requeued":
+		err = j.setStatus(job.Id, "ready")
+	case "resumed":
+		if err = j.setStatus(job.Id, "paused"); err != nil {
+			break
+		}
+		if err = j.resumeJob(job.Id); err != nil {
+			err = fmt.Errorf("j.resumeJob: %s", err.Error())
+			if statusErr := j.setStatus(job.Id, "interrupted"); statusErr != nil {
+				err = fmt.Errorf("%s, j.setStatus: %s", err.Error(), statusErr.Error())
+			}
+			action = "interrupted"
+		}
+	default:
+		err = j.setStatus(job.Id, "interrupted")
+	}
+	if recErr := j.setRecovery(job.Id, action); recErr != nil {
+		if err == nil {
+			err = fmt.Errorf("j.setRecovery: %s", recErr.Error())
+		}
+	}
+	return
+}
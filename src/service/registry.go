@@ -0,0 +1,265 @@
+package service
+
+// running jobs are shared between http handlers, planned ticker,
+// stopJobs, checkpoints and the job goroutines,
+// so every access to them goes through the registry under the lock
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type registry struct {
+	sync.RWMutex
+	running map[int64]*Job
+	cache   map[int64]map[string]struct{}
+	active  sync.WaitGroup // jobs in the registry, done when removed
+	exiting bool
+	exitCtx context.Context // deadline of the shutdown
+}
+
+func newRegistry() *registry {
+	return &registry{
+		running: make(map[int64]*Job),
+		cache:   make(map[int64]map[string]struct{}),
+	}
+}
+
+// add fails if the job is already running, so the job cannot be started twice
+func (r *registry) add(job *Job) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.exiting {
+		return fmt.Errorf("Service is exiting, cannot start: %d", job.Id)
+	}
+	if _, ok := r.running[job.Id]; ok {
+		return fmt.Errorf("Already running: %d", job.Id)
+	}
+	r.running[job.Id] = job
+	r.cache[job.Id] = make(map[string]struct{})
+	job.interrupt = make(chan struct{})
+	r.active.Add(1)
+	return nil
+}
+
+func (r *registry) get(id int64) (*Job, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	job, ok := r.running[id]
+	return job, ok
+}
+
+func (r *registry) remove(id int64) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.running[id]; !ok {
+		return
+	}
+	delete(r.running, id)
+	delete(r.cache, id)
+	r.active.Done()
+}
+
+// requestStop asks the job goroutine to exit with status "canceled" or "paused"
+func (r *registry) requestStop(id int64, pause bool) error {
+	r.Lock()
+	defer r.Unlock()
+	job, ok := r.running[id]
+	if !ok {
+		return fmt.Errorf("Not found: %d", id)
+	}
+	if job.finished {
+		return fmt.Errorf("Already finished: %d, status: %s", id, job.Status)
+	}
+	if pause {
+		job.PauseRequested = true
+	} else {
+		job.StopRequested = true
+	}
+	interrupt(job)
+	return nil
+}
+
+// interrupt wakes the job up from waiting for the rate limit, it is called under the lock
+func interrupt(job *Job) {
+	select {
+	case <-job.interrupt:
+	default:
+		close(job.interrupt)
+	}
+}
+
+// unsent marks the current item as not charged because the job was interrupted,
+// so it isn't moved past and it is the first one on resume
+func (r *registry) unsent(job *Job) {
+	r.Lock()
+	job.retry = true
+	r.Unlock()
+}
+
+// takeUnsent tells if the current item wasn't charged and clears the mark,
+// the item isn't counted as processed, it will be processed again
+func (r *registry) takeUnsent(job *Job) bool {
+	r.Lock()
+	defer r.Unlock()
+	retry := job.retry
+	job.retry = false
+	return retry
+}
+
+// stopRequested returns the status the job must finish with if it was asked to stop
+func (r *registry) stopRequested(job *Job) (bool, string) {
+	r.RLock()
+	defer r.RUnlock()
+	if job.LostClaim {
+		return true, statusLost
+	}
+	if job.Exhausted {
+		return true, statusBudgetExhausted
+	}
+	if r.exiting && !job.StopRequested && !job.PauseRequested {
+		return true, "interrupted"
+	}
+	return job.StopRequested || job.PauseRequested, job.exitStatus()
+}
+
+// loseClaim stops the job which was taken by another instance
+func (r *registry) loseClaim(id int64) {
+	r.Lock()
+	defer r.Unlock()
+	if job, ok := r.running[id]; ok {
+		job.LostClaim = true
+		interrupt(job)
+	}
+}
+
+// shutdown asks every job to stop with status "interrupted" and doesn't allow to start new ones
+func (r *registry) shutdown(ctx context.Context) {
+	r.Lock()
+	r.exiting = true
+	r.exitCtx = ctx
+	for _, job := range r.running {
+		interrupt(job)
+	}
+	r.Unlock()
+}
+
+// exitContext is the deadline of the shutdown, nil if the service isn't exiting
+func (r *registry) exitContext() context.Context {
+	r.RLock()
+	defer r.RUnlock()
+	return r.exitCtx
+}
+
+// wait returns when all jobs are removed from the registry or the context is done
+func (r *registry) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finish is the only transition to the finished state,
+// the first status wins, the later calls are ignored
+func (r *registry) finish(job *Job, status string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if job.finished {
+		return false
+	}
+	job.finished = true
+	job.Status = status
+	return true
+}
+
+// setStatus changes the status of the running job, it is false if the job is finished
+func (r *registry) setStatus(job *Job, status string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if job.finished {
+		return false
+	}
+	job.Status = status
+	return true
+}
+
+func (r *registry) isFinished(job *Job) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return job.finished
+}
+
+// finishedJobs are the jobs which goroutines have exited, but still not removed
+func (r *registry) finishedJobs() (jobs []Job) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, job := range r.running {
+		if job.finished {
+			c := *job
+			c.Stats = job.Stats.copy()
+			jobs = append(jobs, c)
+		}
+	}
+	return
+}
+
+// snapshot copies the running jobs, so they could be read without the lock
+func (r *registry) snapshot() []Job {
+	r.RLock()
+	defer r.RUnlock()
+	jobs := make([]Job, 0, len(r.running))
+	for _, job := range r.running {
+		c := *job
+		c.Stats = job.Stats.copy()
+		jobs = append(jobs, c)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Id < jobs[b].Id })
+	return jobs
+}
+
+func (r *registry) setOffset(job *Job, offset int64) {
+	r.Lock()
+	job.offset = offset
+	r.Unlock()
+}
+
+// handled moves the offset past the item together with its key,
+// so the checkpoint and the key always match
+func (r *registry) handled(job *Job, item Item) {
+	r.Lock()
+	job.offset = item.Idx + 1
+	if item.Key != "" {
+		job.LastKey = item.Key
+	}
+	r.Unlock()
+}
+
+func (r *registry) incProcessed(job *Job) {
+	r.Lock()
+	job.Processed = job.Processed + 1
+	r.Unlock()
+}
+
+// seen checks the msisdn in the job dedup cache and remembers it
+func (r *registry) seen(id int64, msisdn string) bool {
+	r.Lock()
+	defer r.Unlock()
+	cache, ok := r.cache[id]
+	if !ok {
+		return false
+	}
+	if _, ok := cache[msisdn]; ok {
+		return true
+	}
+	cache[msisdn] = struct{}{}
+	return false
+}
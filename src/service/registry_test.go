@@ -0,0 +1,116 @@
+package service
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// run with -race
+func TestRegistryConcurrentStartStopFinish(t *testing.T) {
+	r := newRegistry()
+	count := 100
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		id := int64(i)
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			job := &Job{Id: id}
+			if err := r.add(job); err != nil {
+				return
+			}
+			for k := int64(0); k < 10; k++ {
+				if requested, status := r.stopRequested(job); requested {
+					r.finish(job, status)
+					return
+				}
+				r.setOffset(job, k)
+				r.incProcessed(job)
+				r.seen(id, strconv.FormatInt(k, 10))
+			}
+			r.finish(job, "done")
+		}()
+		go func() {
+			defer wg.Done()
+			r.requestStop(id, id%2 == 0)
+		}()
+		go func() {
+			defer wg.Done()
+			for _, job := range r.snapshot() {
+				job.checkpoint()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, job := range r.finishedJobs() {
+				r.remove(job.Id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, job := range r.finishedJobs() {
+		r.remove(job.Id)
+	}
+	assert.Equal(t, 0, len(r.snapshot()), "all jobs finished")
+}
+
+func TestRegistryTransitions(t *testing.T) {
+	r := newRegistry()
+	job := &Job{Id: 1}
+
+	assert.NoError(t, r.add(job), "add")
+	assert.Error(t, r.add(&Job{Id: 1}), "cannot start twice")
+
+	requested, _ := r.stopRequested(job)
+	assert.False(t, requested, "not requested")
+
+	assert.NoError(t, r.requestStop(1, true), "pause")
+	requested, status := r.stopRequested(job)
+	assert.True(t, requested, "requested")
+	assert.Equal(t, "paused", status, "pause status")
+
+	assert.True(t, r.finish(job, status), "first finish")
+	assert.False(t, r.finish(job, "done"), "second finish ignored")
+	assert.Equal(t, "paused", r.snapshot()[0].Status, "first status wins")
+	assert.Error(t, r.requestStop(1, false), "finished job cannot be stopped")
+
+	assert.False(t, r.seen(1, "923001234567"), "first time")
+	assert.True(t, r.seen(1, "923001234567"), "duplicate")
+
+	r.remove(1)
+	assert.Error(t, r.requestStop(1, false), "not found")
+	assert.Equal(t, 0, len(r.finishedJobs()), "removed")
+}
+
+func TestRegistryLoseClaim(t *testing.T) {
+	r := newRegistry()
+	job := &Job{Id: 1}
+	assert.NoError(t, r.add(job), "add")
+	assert.NoError(t, r.requestStop(1, true), "pause")
+
+	r.loseClaim(1)
+	requested, status := r.stopRequested(job)
+	assert.True(t, requested, "requested")
+	assert.Equal(t, statusLost, status, "lost claim wins over pause")
+
+	r.loseClaim(2) // not running
+}
+
+func TestRegistryHandled(t *testing.T) {
+	r := newRegistry()
+	job := &Job{Id: 1, Skip: 2, LastKey: "923001112233"}
+	assert.NoError(t, r.add(job), "add")
+
+	r.handled(job, Item{Idx: 0})
+	assert.Equal(t, int64(2), job.checkpoint(), "skip until the key")
+	assert.Equal(t, "923001112233", job.LastKey, "placeholder keeps the key")
+
+	r.handled(job, Item{Idx: 2, Key: "923004445566"})
+	assert.Equal(t, int64(3), job.checkpoint())
+	assert.Equal(t, "923004445566", job.LastKey)
+}
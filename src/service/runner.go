@@ -0,0 +1,125 @@
+package service
+
+// every job type is a JobRunner registered in init() of its own file,
+// the job goroutine is the same for all types: it takes the items one by one
+// until there is nothing left or the job is asked to stop
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/rec"
+)
+
+type JobRunner interface {
+	// Validate checks the type specific params when the job is created
+	Validate(job *Job) error
+	// Prepare is called on start and resume, before the job gets into the registry
+	Prepare(job *Job) error
+	// Next returns the item with index idx, io.EOF when there is nothing left
+	// any other error stops the job with status "error"
+	Next(job *Job, idx int64) (Item, error)
+	// Process handles the item, items before job.Skip are only skipped
+	Process(job *Job, item Item)
+	// Finalize releases everything taken in Prepare
+	Finalize(job *Job)
+}
+
+// Item is the line of the injection file, the expired retry, etc
+type Item struct {
+	Idx      int64
+	Orig     string // as it was read
+	Msisdn   string
+	Record   rec.Record
+	Key      string // saved with the checkpoint, the runner could continue after it on resume
+	Priority uint8  // of the charge request
+	Err      error  // the item is wrong and must be skipped
+}
+
+var runners = make(map[string]func() JobRunner)
+
+// registerRunner is called in init(), the runner is created for every started job
+func registerRunner(jobType string, newFn func() JobRunner) {
+	if _, ok := runners[jobType]; ok {
+		panic("runner already registered: " + jobType)
+	}
+	runners[jobType] = newFn
+}
+
+func newRunner(jobType string) (JobRunner, error) {
+	newFn, ok := runners[jobType]
+	if !ok {
+		return nil, fmt.Errorf("unknown job type: %s", jobType)
+	}
+	return newFn(), nil
+}
+
+func (j *Job) run() {
+	log.WithFields(log.Fields{
+		"id":   j.Id,
+		"type": j.Type,
+		"skip": j.Skip,
+	}).Info("run")
+
+	go func() {
+		defer j.runner.Finalize(j)
+
+		var idx int64
+		for {
+			svc.jobs.registry.setOffset(j, idx)
+			if requested, status := svc.jobs.registry.stopRequested(j); requested {
+				log.WithFields(log.Fields{
+					"id":     j.Id,
+					"status": status,
+				}).Info("exiting")
+				svc.jobs.registry.finish(j, status)
+				return
+			}
+
+			if idx >= j.Skip {
+				j.waitWindow()
+				if requested, _ := svc.jobs.registry.stopRequested(j); requested {
+					continue
+				}
+			}
+
+			item, err := j.runner.Next(j, idx)
+			if err == io.EOF {
+				log.WithFields(log.Fields{
+					"id":    j.Id,
+					"count": idx,
+				}).Info("done")
+				svc.jobs.registry.finish(j, "done")
+				return
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":    j.Id,
+					"idx":   idx,
+					"error": err.Error(),
+				}).Error("cannt process")
+				svc.jobs.registry.finish(j, "error")
+				return
+			}
+
+			j.runner.Process(j, item)
+			if _, status := svc.jobs.registry.stopRequested(j); status == statusBudgetExhausted {
+				// the item wasn't charged, so it is the first one on resume
+				log.WithFields(log.Fields{
+					"id":  j.Id,
+					"idx": idx,
+				}).Info("budget exhausted")
+				svc.jobs.registry.finish(j, statusBudgetExhausted)
+				return
+			}
+			if svc.jobs.registry.takeUnsent(j) {
+				// interrupted while waiting for the rate limit, the item is the first one on resume
+				continue
+			}
+			svc.jobs.registry.handled(j, item)
+			idx++
+		}
+	}()
+}
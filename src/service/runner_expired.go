@@ -0,0 +1,137 @@
+package service
+
+// expired charges the msisdns from retries_expired selected by params,
+// skip is the number of retries to skip.
+// the retries are streamed by pages of jobs.expired_page_size ordered by msisdn,
+// on resume the query continues after the last key saved with the checkpoint
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+
+	mid_client "github.com/linkit360/go-mid/rpcclient"
+	"github.com/linkit360/go-utils/rec"
+)
+
+func init() {
+	registerRunner("expired", func() JobRunner {
+		return &expired{}
+	})
+}
+
+type expired struct {
+	after   string // msisdn of the last loaded retry
+	eof     bool
+	records []rec.Record
+	pos     int
+}
+
+func (e *expired) Validate(job *Job) error {
+	_, _, err := expiredQuery(job.ParsedParams, "", 0)
+	return err
+}
+
+func (e *expired) Prepare(j *Job) error {
+	if j.resumed {
+		e.after = j.LastKey
+	}
+	// the retries of other services are charged with the price of the service in params
+	if j.ParsedParams.ServiceCode != "" {
+		s, err := mid_client.GetServiceByCode(j.ParsedParams.ServiceCode)
+		if err != nil {
+			return fmt.Errorf("mid_client.GetServiceByCode: %s", err.Error())
+		}
+		j.PriceCents = s.PriceCents
+	}
+	return nil
+}
+
+// Next loads the retries page by page, so the first retries are sent without waiting for the rest
+func (e *expired) Next(j *Job, idx int64) (item Item, err error) {
+	if j.ParsedParams.Count > 0 && idx >= j.ParsedParams.Count {
+		return item, io.EOF
+	}
+	// handled before the last key, the query starts after them
+	if e.after != "" && idx < j.Skip && e.records == nil {
+		return Item{Idx: idx}, nil
+	}
+	if e.pos >= len(e.records) {
+		if e.eof {
+			return item, io.EOF
+		}
+		limit := svc.jobs.conf.ExpiredPageSize
+		if left := j.ParsedParams.Count - idx; j.ParsedParams.Count > 0 && left < int64(limit) {
+			limit = int(left)
+		}
+		if e.records, err = svc.jobs.getExpiredPage(j.ParsedParams, e.after, limit); err != nil {
+			return item, fmt.Errorf("svc.jobs.getExpiredPage: %s", err.Error())
+		}
+		e.pos = 0
+		e.eof = limit <= 0 || len(e.records) < limit
+		if len(e.records) == 0 {
+			return item, io.EOF
+		}
+	}
+	r := e.records[e.pos]
+	e.pos++
+	e.after = r.Msisdn
+	return Item{
+		Idx:    idx,
+		Msisdn: r.Msisdn,
+		Record: r,
+		Key:    r.Msisdn,
+	}, nil
+}
+
+func (e *expired) Process(j *Job, item Item) {
+	r := item.Record
+	if item.Idx < j.Skip && item.Key == "" {
+		return
+	}
+	if item.Idx < j.Skip {
+		log.WithFields(log.Fields{
+			"tid": r.Tid,
+			"id":  r.RetryId,
+		}).Info("skip")
+		j.logMsisdn(r.RetryId, r.Msisdn, actionSkip, nil)
+		return
+	}
+	log.WithFields(log.Fields{
+		"tid": r.Tid,
+	}).Info("process")
+
+	if j.ParsedParams.ServiceCode != "" {
+		r.ServiceCode = j.ParsedParams.ServiceCode
+	}
+	if j.ParsedParams.CampaignId != "" {
+		r.CampaignId = j.ParsedParams.CampaignId
+	}
+
+	if svc.jobs.registry.seen(j.Id, r.Msisdn) {
+		log.WithFields(log.Fields{
+			"tid": r.Tid,
+		}).Info("duplicate")
+
+		j.logMsisdn(r.RetryId, r.Msisdn, actionDuplicate, nil)
+		return
+	}
+
+	r.Type = "expired"
+	// the price of the retry otherwise
+	if j.PriceCents > 0 {
+		r.Price = j.PriceCents
+	}
+	r.AttemptsCount = 10 // any, just more than 0
+
+	action := j.charge(r.RetryId, r, 0)
+	if countsProcessed(action) {
+		svc.jobs.registry.incProcessed(j)
+	}
+	j.logMsisdn(r.RetryId, r.Msisdn, action, nil)
+}
+
+func (e *expired) Finalize(j *Job) {
+	e.records = nil
+}
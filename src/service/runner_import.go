@@ -0,0 +1,170 @@
+package service
+
+// list_import adds the msisdns from the csv file in injections_path to params.list,
+// the msisdn is the first column, it is normalized by the rules of any configured operator.
+// the rejected lines are written to the report, GET /jobs/id/:id/report
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	actionImported = "imported"
+	actionListed   = "already listed"
+)
+
+func init() {
+	registerRunner("list_import", func() JobRunner {
+		return &listImport{}
+	})
+}
+
+type listImport struct {
+	list    msisdnList
+	fh      io.ReadCloser
+	scanner *bufio.Scanner
+	report  *os.File
+	rejects *csv.Writer
+}
+
+// reportPath is the report of the rejected lines of the job
+func reportPath(id int64) string {
+	return svc.jobs.conf.LogPath + "jobs_" + strconv.FormatInt(id, 10) + "_rejected.csv"
+}
+
+func (li *listImport) Validate(job *Job) error {
+	if job.ParsedParams.List == "" {
+		return errors.New("list required")
+	}
+	if _, err := getMsisdnList(job.ParsedParams.List); err != nil {
+		return err
+	}
+	return checkInjectionFile(job.FileName)
+}
+
+func (li *listImport) Prepare(j *Job) (err error) {
+	if li.list, err = getMsisdnList(j.ParsedParams.List); err != nil {
+		return err
+	}
+	// nothing is charged, the send windows don't apply
+	j.window = nil
+
+	path := svc.jobs.conf.InjectionsPath + "/" + j.FileName
+	if li.fh, err = openInput(path); err != nil {
+		return err
+	}
+	li.scanner = bufio.NewScanner(li.fh)
+
+	// the report is continued on resume
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if j.resumed {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	if li.report, err = os.OpenFile(reportPath(j.Id), flags, 0644); err != nil {
+		li.fh.Close()
+		return fmt.Errorf("os.OpenFile: %s, path: %s", err.Error(), reportPath(j.Id))
+	}
+	li.rejects = csv.NewWriter(li.report)
+	if fi, err := li.report.Stat(); err == nil && fi.Size() == 0 {
+		li.rejects.Write([]string{"line", "orig", "reason"})
+	}
+	log.WithFields(log.Fields{
+		"id":   j.Id,
+		"path": path,
+		"list": li.list.name,
+	}).Info("opened")
+	return nil
+}
+
+func (li *listImport) Next(j *Job, idx int64) (item Item, err error) {
+	if j.ParsedParams.Count > 0 && j.Processed >= j.ParsedParams.Count {
+		return item, io.EOF
+	}
+	if !li.scanner.Scan() {
+		if err = li.scanner.Err(); err != nil {
+			return item, fmt.Errorf("scanner.Error: %s", err.Error())
+		}
+		return item, io.EOF
+	}
+	item = Item{
+		Idx:  idx,
+		Orig: li.scanner.Text(),
+	}
+	if idx < j.Skip {
+		return
+	}
+	fields, err := csv.NewReader(strings.NewReader(item.Orig)).Read()
+	if err != nil {
+		item.Err = errInvalidMsisdn(fmt.Sprintf("Wrong csv line: %s", err.Error()))
+		return item, nil
+	}
+	item.Msisdn, item.Err = svc.jobs.normalizeAny(fields[0])
+	return item, nil
+}
+
+func (li *listImport) Process(j *Job, item Item) {
+	var action string
+	i, orig, msisdn, err := item.Idx, item.Orig, item.Msisdn, item.Err
+	defer func() {
+		j.logMsisdn(i, orig, action, err)
+	}()
+	if i < j.Skip {
+		action = actionSkip
+		return
+	}
+	svc.jobs.registry.incProcessed(j)
+
+	if err != nil {
+		action = invalidAction(err)
+		li.reject(i, orig, err)
+		return
+	}
+
+	added, err := svc.jobs.addListed(li.list, msisdn)
+	if err != nil {
+		action = actionError
+		li.reject(i, orig, err)
+		log.WithFields(log.Fields{
+			"msisdn": msisdn,
+			"list":   li.list.name,
+			"error":  err.Error(),
+		}).Error("cannt add to list")
+		return
+	}
+	action = actionImported
+	if !added {
+		action = actionListed
+	}
+}
+
+func (li *listImport) reject(idx int64, orig string, reason error) {
+	li.rejects.Write([]string{strconv.FormatInt(idx+1, 10), orig, reason.Error()})
+	li.rejects.Flush()
+}
+
+func (li *listImport) Finalize(j *Job) {
+	closers := []io.Closer{}
+	if li.fh != nil {
+		closers = append(closers, li.fh)
+	}
+	if li.report != nil {
+		closers = append(closers, li.report)
+	}
+	for _, fh := range closers {
+		if err := fh.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"id":    j.Id,
+				"error": err.Error(),
+			}).Error("close file")
+		}
+	}
+}
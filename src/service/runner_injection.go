@@ -0,0 +1,474 @@
+package service
+
+// injection charges the msisdns from the file in injections_path, one msisdn per line
+// or csv rows with params.format csv, see runner_injection_csv.go,
+// skip is the number of lines to skip, count is the number of lines to process.
+// the file is read and checked by chunks of jobs.check_batch_size in the background,
+// so the next chunk is checked while the current one is published
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/config"
+	"github.com/linkit360/go-jobs/src/msisdn"
+	mid_client "github.com/linkit360/go-mid/rpcclient"
+	"github.com/linkit360/go-mid/service"
+	"github.com/linkit360/go-utils/rec"
+)
+
+func init() {
+	registerRunner("injection", func() JobRunner {
+		return &injection{}
+	})
+}
+
+var errPaidInTransactions = errors.New("Paid in transactions")
+
+// errInvalidMsisdn is returned when the line is not a msisdn we can charge
+type errInvalidMsisdn string
+
+func (e errInvalidMsisdn) Error() string {
+	return string(e)
+}
+
+type injection struct {
+	code     int64 // operator
+	operator config.OperatorConfig
+	rules    msisdn.Rules
+	header   csvHeader // of csv format, nil for lines
+	headed   bool      // the csv has the header
+	services map[string]rowService
+	fh       io.ReadCloser
+	scanner  *bufio.Scanner
+	chunks   chan chunk
+	done     chan struct{} // closed in Finalize
+	stopped  chan struct{} // closed when the reader has exited
+	current  []Item
+	checked  time.Time // of the current chunk
+}
+
+// rowService is the price and the campaign of the service set in the csv row
+type rowService struct {
+	price      int
+	campaignId string
+}
+
+// chunk is the checked lines of the file, err stops the job
+type chunk struct {
+	items     []Item
+	checkedAt time.Time // the paid msisdns were looked up
+	err       error
+}
+
+func (in *injection) Validate(job *Job) error {
+	switch job.ParsedParams.Format {
+	case "", formatLines:
+		if job.ParsedParams.ServiceCode == "" {
+			return errors.New("service_code required")
+		}
+	case formatCSV:
+	default:
+		return fmt.Errorf("format must be %s or %s: %s", formatLines, formatCSV, job.ParsedParams.Format)
+	}
+	if _, _, err := svc.jobs.jobOperator(job.ParsedParams); err != nil {
+		return err
+	}
+	return checkInjectionFile(job.FileName)
+}
+
+// checkInjectionFile checks the file is in injections_path and could be read, the archive too
+func checkInjectionFile(fileName string) error {
+	if fileName == "" {
+		return errors.New("file_name required")
+	}
+	if strings.Contains(fileName, "..") {
+		return fmt.Errorf("wrong file_name: %s", fileName)
+	}
+	path := svc.jobs.conf.InjectionsPath + "/" + fileName
+	fh, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+func (in *injection) Prepare(j *Job) error {
+	var err error
+	if in.code, in.operator, err = svc.jobs.jobOperator(j.ParsedParams); err != nil {
+		return err
+	}
+	in.rules = operatorRules(in.operator)
+	in.services = make(map[string]rowService)
+	// csv rows could have their own services only
+	if j.ParsedParams.ServiceCode != "" {
+		s, err := in.service(j.ParsedParams.ServiceCode)
+		if err != nil {
+			return err
+		}
+		j.PriceCents = s.price
+		if j.ParsedParams.CampaignId == "" {
+			j.ParsedParams.CampaignId = s.campaignId
+		}
+	}
+
+	if j.FileName == "" {
+		return fmt.Errorf("File name is empty: %s", j.FileName)
+	}
+	path := svc.jobs.conf.InjectionsPath + "/" + j.FileName
+	if in.fh, err = openInput(path); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":   j.Id,
+		"path": path,
+	}).Info("opened")
+	in.scanner = bufio.NewScanner(in.fh)
+
+	in.chunks = make(chan chunk, 1)
+	in.done = make(chan struct{})
+	in.stopped = make(chan struct{})
+	go in.readChunks(j.Id, j.Skip, j.resumed, j.ParsedParams)
+	return nil
+}
+
+func (in *injection) Next(j *Job, idx int64) (item Item, err error) {
+	if j.ParsedParams.Count > 0 && j.Processed >= j.ParsedParams.Count {
+		return item, io.EOF
+	}
+	if len(in.current) == 0 {
+		c, ok := <-in.chunks
+		if !ok {
+			return item, io.EOF
+		}
+		if c.err != nil {
+			return item, c.err
+		}
+		in.current, in.checked = c.items, c.checkedAt
+	}
+	if err = in.recheckPaid(j); err != nil {
+		return item, err
+	}
+	item, in.current = in.current[0], in.current[1:]
+	return item, nil
+}
+
+// recheckPaid looks up the paid msisdns of the current chunk again
+// if the job has waited for the window since they were checked, they could be paid meanwhile
+func (in *injection) recheckPaid(j *Job) error {
+	p := j.ParsedParams
+	if (p.LastChargeAt == "" && p.Never == 0) || !in.checked.Before(j.windowOpenedAt) {
+		return nil
+	}
+	msisdns := []string{}
+	for _, it := range in.current {
+		if it.Err == nil && it.Msisdn != "" {
+			msisdns = append(msisdns, it.Msisdn)
+		}
+	}
+	in.checked = time.Now()
+	if len(msisdns) == 0 {
+		return nil
+	}
+	paid, err := svc.jobs.paidMsisdns(p, msisdns)
+	if err != nil {
+		return fmt.Errorf("svc.jobs.paidMsisdns: %s", err.Error())
+	}
+	for i := range in.current {
+		if _, ok := paid[in.current[i].Msisdn]; ok && in.current[i].Err == nil {
+			in.current[i].Err = errPaidInTransactions
+		}
+	}
+	log.WithFields(log.Fields{
+		"id":      j.Id,
+		"checked": len(msisdns),
+		"paid":    len(paid),
+	}).Info("rechecked after window")
+	return nil
+}
+
+// readChunks reads the file by chunks until the end or until Finalize
+func (in *injection) readChunks(id, skip int64, resumed bool, p Params) {
+	defer close(in.stopped)
+	defer close(in.chunks)
+
+	size := svc.jobs.conf.CheckBatchSize
+	if size <= 0 {
+		size = 1
+	}
+	var idx int64
+	for {
+		c := chunk{}
+		for len(c.items) < size && in.scanner.Scan() {
+			if p.Format == formatCSV && (in.header == nil || in.headed) {
+				// the header of every file of zip is skipped
+				fields, _ := csv.NewReader(strings.NewReader(in.scanner.Text())).Read()
+				if h, ok := detectHeader(fields); ok {
+					if in.header == nil {
+						in.header, in.headed = h, true
+					}
+					continue
+				}
+				if in.header == nil {
+					in.header = defaultHeader()
+				}
+			}
+			c.items = append(c.items, Item{
+				Idx:  idx,
+				Orig: in.scanner.Text(),
+			})
+			idx++
+		}
+		if err := in.scanner.Err(); err != nil {
+			c.err = fmt.Errorf("scanner.Error: %s", err.Error())
+		} else if len(c.items) == 0 {
+			return
+		} else {
+			c.checkedAt = time.Now()
+			c.err = in.checkChunk(id, skip, resumed, p, c.items)
+		}
+
+		select {
+		case in.chunks <- c:
+		case <-in.done:
+			return
+		}
+		if c.err != nil {
+			return
+		}
+	}
+}
+
+// checkChunk makes msisdns from the lines and checks if they could be charged
+func (in *injection) checkChunk(id, skip int64, resumed bool, p Params, items []Item) error {
+	msisdns := []string{}
+	for i := range items {
+		it := &items[i]
+		if it.Idx < skip {
+			if resumed {
+				in.parse(it)
+			}
+			it.Err = fmt.Errorf("%d skip until: %d", it.Idx, skip)
+			continue
+		}
+		if in.parse(it); it.Err == nil {
+			msisdns = append(msisdns, it.Msisdn)
+		}
+	}
+	if len(msisdns) == 0 || (p.LastChargeAt == "" && p.Never == 0) {
+		return nil
+	}
+
+	begin := time.Now()
+	paid, err := svc.jobs.paidMsisdns(p, msisdns)
+	if err != nil {
+		return fmt.Errorf("svc.jobs.paidMsisdns: %s", err.Error())
+	}
+	for i := range items {
+		if _, ok := paid[items[i].Msisdn]; ok && items[i].Err == nil {
+			items[i].Err = errPaidInTransactions
+		}
+	}
+	log.WithFields(log.Fields{
+		"id":             id,
+		"from":           items[0].Idx,
+		"checked":        len(msisdns),
+		"paid":           len(paid),
+		"last_charge_at": p.LastChargeAt,
+		"never":          p.Never,
+		"took":           time.Since(begin),
+	}).Info("checked")
+	return nil
+}
+
+func (in *injection) Process(j *Job, item Item) {
+	var action string
+	i, orig, msisdn, err := item.Idx, item.Orig, item.Msisdn, item.Err
+	defer func() {
+		j.logMsisdn(i, orig, action, err)
+	}()
+	if i < j.Skip {
+		action = actionSkip
+		// on resume the lines handled before the pause must be deduplicated too
+		if j.resumed && i >= j.Skip-j.Processed && msisdn != "" {
+			svc.jobs.registry.seen(j.Id, dedupKey(item))
+		}
+		log.WithFields(log.Fields{
+			"reason": err.Error(),
+		}).Warn("skip")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"idx":        i,
+		"msisdn":     msisdn,
+		"orig":       orig,
+		"skip":       j.Skip,
+		"processsed": j.Processed,
+	}).Debug("consider..")
+	defer func() {
+		if countsProcessed(action) {
+			svc.jobs.registry.incProcessed(j)
+		}
+	}()
+
+	if err == errPaidInTransactions {
+		action = actionPaid
+		log.WithFields(log.Fields{
+			"msisdn": msisdn,
+		}).Warn("already paid")
+		return
+	}
+
+	if err != nil {
+		action = actionError
+		if invalidMsisdn(err) {
+			action = invalidAction(err)
+		}
+		if _, ok := err.(errInvalidRow); ok {
+			action = actionInvalidRow
+		}
+		log.WithFields(log.Fields{
+			"orig":   orig,
+			"msisdn": msisdn,
+			"error":  err.Error(),
+		}).Error("skip")
+		return
+	}
+
+	if svc.jobs.registry.seen(j.Id, dedupKey(item)) {
+		log.WithFields(log.Fields{
+			"msisdn": msisdn,
+		}).Info("duplicate")
+		action = actionDuplicate
+		return
+	}
+
+	r := rec.Record{
+		CampaignId:    j.ParsedParams.CampaignId,
+		ServiceCode:   j.ParsedParams.ServiceCode,
+		OperatorCode:  in.code,
+		CountryCode:   in.operator.CountryCode,
+		Msisdn:        msisdn,
+		Tid:           rec.GenerateTID(msisdn),
+		Price:         j.PriceCents,
+		AttemptsCount: 10, // any, just more than 0
+		Type:          "injection",
+	}
+	if err = in.override(&r, item.Record); err != nil {
+		action = actionInvalidRow
+		if _, ok := err.(errInvalidRow); !ok {
+			action = actionError
+		}
+		log.WithFields(log.Fields{
+			"orig":  orig,
+			"error": err.Error(),
+		}).Error("skip")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"tid":    r.Tid,
+		"msisdn": r.Msisdn,
+	}).Info("process")
+
+	action = j.charge(i, r, item.Priority)
+}
+
+// parse makes the msisdn from the line and the overrides from the csv row
+func (in *injection) parse(it *Item) {
+	if in.header != nil {
+		in.parseRow(it)
+		return
+	}
+	it.Msisdn, it.Err = in.rules.Normalize(it.Orig)
+}
+
+// dedupKey is the msisdn, with the service if it is set in the csv row
+func dedupKey(item Item) string {
+	if item.Record.ServiceCode != "" {
+		return item.Msisdn + "/" + item.Record.ServiceCode
+	}
+	return item.Msisdn
+}
+
+// service returns the price and the campaign of the service, they are taken from mid once per job
+func (in *injection) service(code string) (rowService, error) {
+	if s, ok := in.services[code]; ok {
+		return s, nil
+	}
+	s, err := mid_client.GetServiceByCode(code)
+	if err != nil {
+		return rowService{}, fmt.Errorf("mid_client.GetServiceByCode: %s", err.Error())
+	}
+	var camp service.Campaign
+	if camp, err = mid_client.GetCampaignByServiceCode(code); err != nil {
+		return rowService{}, fmt.Errorf("mid_client.GetCampaignByServiceCode: %s", err.Error())
+	}
+	in.services[code] = rowService{price: s.PriceCents, campaignId: camp.Id}
+	return in.services[code], nil
+}
+
+// override sets the service, the campaign and the price of the csv row,
+// the service of the row brings its own price and campaign unless the row has them
+func (in *injection) override(r *rec.Record, row rec.Record) error {
+	if row.ServiceCode != "" && row.ServiceCode != r.ServiceCode {
+		s, err := in.service(row.ServiceCode)
+		if err != nil {
+			return err
+		}
+		r.ServiceCode = row.ServiceCode
+		r.Price = s.price
+		r.CampaignId = s.campaignId
+	}
+	if r.ServiceCode == "" {
+		return errInvalidRow("service_code required")
+	}
+	if row.CampaignId != "" {
+		r.CampaignId = row.CampaignId
+	}
+	if row.Price > 0 {
+		r.Price = row.Price
+	}
+	return nil
+}
+
+func (in *injection) Finalize(j *Job) {
+	if in.done != nil {
+		close(in.done)
+		<-in.stopped
+	}
+	if in.fh == nil {
+		return
+	}
+	if err := in.fh.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"id":    j.Id,
+			"error": err.Error(),
+		}).Error("close file")
+	}
+}
+
+// invalidAction is the action of the rejected msisdn, the reason of the normalization if it is known
+func invalidAction(err error) string {
+	if e, ok := err.(*msisdn.Error); ok {
+		return string(e.Reason)
+	}
+	return actionInvalid
+}
+
+// invalidMsisdn tells if the line was rejected by the normalization
+func invalidMsisdn(err error) bool {
+	switch err.(type) {
+	case errInvalidMsisdn, *msisdn.Error:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package service
+
+// csv injection files, params.format csv: msisdn,service_code,campaign_id,price,priority
+// the header is optional, it is detected by the msisdn column, the columns could be in any order.
+// the empty column falls back to the job params: service_code, campaign_id and the price of the service
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatLines = "lines"
+	formatCSV   = "csv"
+
+	actionInvalidRow = "invalid row"
+)
+
+var csvColumns = []string{"msisdn", "service_code", "campaign_id", "price", "priority"}
+
+// csvHeader is the index of the column, -1 if there is no such column
+type csvHeader map[string]int
+
+func defaultHeader() csvHeader {
+	h := make(csvHeader)
+	for i, column := range csvColumns {
+		h[column] = i
+	}
+	return h
+}
+
+// detectHeader returns the header if the fields are the column names
+func detectHeader(fields []string) (csvHeader, bool) {
+	h := make(csvHeader)
+	for _, column := range csvColumns {
+		h[column] = -1
+	}
+	for i, f := range fields {
+		name := strings.ToLower(strings.TrimSpace(f))
+		if _, ok := h[name]; ok {
+			h[name] = i
+		}
+	}
+	return h, h["msisdn"] >= 0
+}
+
+// errInvalidRow is the row with the wrong override
+type errInvalidRow string
+
+func (e errInvalidRow) Error() string {
+	return string(e)
+}
+
+func (h csvHeader) get(fields []string, column string) string {
+	i := h[column]
+	if i < 0 || i >= len(fields) {
+		return ""
+	}
+	return strings.TrimSpace(fields[i])
+}
+
+// parseRow makes the item from the csv line, the overrides go to item.Record
+func (in *injection) parseRow(it *Item) {
+	fields, err := csv.NewReader(strings.NewReader(it.Orig)).Read()
+	if err != nil {
+		it.Err = errInvalidRow(fmt.Sprintf("Wrong csv line: %s", err.Error()))
+		return
+	}
+	h := in.header
+	it.Record.ServiceCode = h.get(fields, "service_code")
+	it.Record.CampaignId = h.get(fields, "campaign_id")
+	if it.Msisdn, it.Err = in.rules.Normalize(h.get(fields, "msisdn")); it.Err != nil {
+		return
+	}
+	if v := h.get(fields, "price"); v != "" {
+		if it.Record.Price, err = strconv.Atoi(v); err != nil || it.Record.Price <= 0 {
+			it.Err = errInvalidRow(fmt.Sprintf("Wrong price: %s", v))
+			return
+		}
+	}
+	if v := h.get(fields, "priority"); v != "" {
+		priority, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || priority > 9 {
+			it.Err = errInvalidRow(fmt.Sprintf("Wrong priority, expected 0-9: %s", v))
+			return
+		}
+		it.Priority = uint8(priority)
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+	"github.com/linkit360/go-jobs/src/msisdn"
+	"github.com/linkit360/go-utils/rec"
+)
+
+func TestInjectionChunks(t *testing.T) {
+	saved := svc.jobs
+	defer func() { svc.jobs = saved }()
+	svc.jobs = &jobs{conf: config.JobsConfig{CheckBatchSize: 2}}
+
+	job := &Job{Id: 1, Skip: 1}
+	in := &injection{
+		rules:   operatorRules(config.OperatorConfig{CountryCode: 92, Prefixes: []string{"92"}}),
+		scanner: bufio.NewScanner(strings.NewReader("923001112233\n923004445566\n12345\n+92 300 777-8899;\n")),
+		chunks:  make(chan chunk, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go in.readChunks(job.Id, job.Skip, job.resumed, job.ParsedParams)
+	defer in.Finalize(job)
+
+	var items []Item
+	for idx := int64(0); ; idx++ {
+		item, err := in.Next(job, idx)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, idx, item.Idx, "items in order")
+		items = append(items, item)
+	}
+	assert.Len(t, items, 4)
+	assert.Error(t, items[0].Err, "skipped")
+	assert.Equal(t, "923004445566", items[1].Msisdn)
+	assert.True(t, invalidMsisdn(items[2].Err), "wrong country")
+	assert.Equal(t, string(msisdn.ReasonCountry), invalidAction(items[2].Err))
+	assert.Equal(t, actionInvalid, invalidAction(errInvalidMsisdn("Wrong csv line")))
+	assert.Equal(t, "923007778899", items[3].Msisdn, "normalized")
+	assert.NoError(t, items[3].Err)
+
+	assert.Equal(t, "{923001112233,923004445566}", pgArray([]string{"923001112233", "923004445566"}))
+}
+
+func TestInjectionCSV(t *testing.T) {
+	saved := svc.jobs
+	defer func() { svc.jobs = saved }()
+	svc.jobs = &jobs{conf: config.JobsConfig{CheckBatchSize: 10}}
+
+	job := &Job{Id: 1, ParsedParams: Params{Format: formatCSV, ServiceCode: "111"}}
+	in := &injection{
+		rules: operatorRules(config.OperatorConfig{CountryCode: 92, Prefixes: []string{"92"}}),
+		scanner: bufio.NewScanner(strings.NewReader("Priority,MSISDN,campaign_id,price\n" +
+			"5,03001112233,camp,300\n" +
+			",923004445566,,\n" +
+			"1,923007778899,,-1\n" +
+			"priority,msisdn,campaign_id,price\n" +
+			"10,923007778899,,\n")),
+		chunks:  make(chan chunk, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go in.readChunks(job.Id, job.Skip, job.resumed, job.ParsedParams)
+	defer in.Finalize(job)
+
+	var items []Item
+	for idx := int64(0); ; idx++ {
+		item, err := in.Next(job, idx)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		items = append(items, item)
+	}
+	if !assert.Len(t, items, 4, "header is not an item") {
+		return
+	}
+	assert.NoError(t, items[0].Err)
+	assert.Equal(t, "923001112233", items[0].Msisdn)
+	assert.Equal(t, uint8(5), items[0].Priority)
+
+	r := rec.Record{ServiceCode: "111", CampaignId: "job", Price: 100}
+	assert.NoError(t, in.override(&r, items[0].Record))
+	assert.Equal(t, rec.Record{ServiceCode: "111", CampaignId: "camp", Price: 300}, r, "overrides")
+
+	r = rec.Record{ServiceCode: "111", CampaignId: "job", Price: 100}
+	assert.NoError(t, items[1].Err)
+	assert.NoError(t, in.override(&r, items[1].Record))
+	assert.Equal(t, rec.Record{ServiceCode: "111", CampaignId: "job", Price: 100}, r, "job params")
+
+	assert.IsType(t, errInvalidRow(""), items[2].Err, "price")
+	assert.IsType(t, errInvalidRow(""), items[3].Err, "priority")
+
+	assert.Error(t, in.override(&rec.Record{}, rec.Record{}), "no service")
+}
+
+func TestDetectHeader(t *testing.T) {
+	_, ok := detectHeader([]string{"923001112233", "111"})
+	assert.False(t, ok, "no header")
+
+	h, ok := detectHeader([]string{"service_code", " msisdn "})
+	assert.True(t, ok)
+	assert.Equal(t, 1, h["msisdn"])
+	assert.Equal(t, -1, h["price"])
+}
@@ -0,0 +1,371 @@
+package service
+
+// the scheduler sleeps until the next run_at of the ready jobs or next_run_at of the templates,
+// it is woken up earlier when a job or a template is created or updated.
+// on db errors it waits with backoff and tries again, the failed start of the job
+// is retried with backoff of its own, so one broken job doesn't spin the loop
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/cron"
+)
+
+// what to do with the job if its run_at passed while the service was down
+const (
+	missedRunNow = "run_now" // start anyway, by default
+	missedGrace  = "grace"   // start if it is late for less than grace_minutes
+	// missedSkip sets status "missed"
+)
+
+const minBackoff = time.Second
+
+type scheduler struct {
+	sync.Mutex
+	wake     chan struct{}
+	nextWake time.Time
+	backoff  time.Duration
+	failed   map[int64]failedStart
+	deferred map[int64]struct{} // waited for the window, so they are not missed
+}
+
+type failedStart struct {
+	retryAt time.Time
+	backoff time.Duration
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		wake:     make(chan struct{}, 1),
+		failed:   make(map[int64]failedStart),
+		deferred: make(map[int64]struct{}),
+	}
+}
+
+// wakeScheduler makes the scheduler check the jobs now, it never blocks
+func (j *jobs) wakeScheduler() {
+	select {
+	case j.scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (j *jobs) planned() {
+	s := j.scheduler
+	maxSleep := time.Duration(j.conf.PlannedPeriodMinutes) * time.Minute
+	if maxSleep <= 0 {
+		maxSleep = time.Minute
+	}
+	maxBackoff := time.Duration(j.conf.SchedulerMaxBackoffSeconds) * time.Second
+
+	for {
+		now := time.Now().UTC()
+		next, err := j.schedule(now)
+		sleep := next.Sub(now)
+
+		s.Lock()
+		if err != nil {
+			if s.backoff < minBackoff {
+				s.backoff = minBackoff
+			} else if s.backoff *= 2; s.backoff > maxBackoff {
+				s.backoff = maxBackoff
+			}
+			sleep = s.backoff
+			log.WithFields(log.Fields{
+				"error":   err.Error(),
+				"backoff": s.backoff,
+			}).Error("schedule failed")
+		} else {
+			s.backoff = 0
+		}
+		if next.IsZero() || sleep > maxSleep {
+			sleep = maxSleep
+		}
+		if sleep < 0 {
+			sleep = 0
+		}
+		s.nextWake = now.Add(sleep)
+		s.Unlock()
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// schedule fires the templates, starts the due jobs and returns the time of the next run
+func (j *jobs) schedule(now time.Time) (next time.Time, err error) {
+	if err = j.fireTemplates(now); err != nil {
+		return
+	}
+
+	jobs, err := j.getList(JobsFilter{Status: "ready", DateTo: now.Add(time.Millisecond)})
+	if err != nil {
+		return
+	}
+	j.scheduler.keep(jobs)
+	for _, job := range jobs {
+		if retryAt, ok := j.scheduler.retryAt(job.Id); ok && retryAt.After(now) {
+			next = earliest(next, retryAt)
+			continue
+		}
+		next = earliest(next, j.startPlanned(job, now))
+	}
+
+	var nextJob, nextTemplate time.Time
+	if nextJob, nextTemplate, err = j.nextPlanned(now); err != nil {
+		return
+	}
+	next = earliest(earliest(next, nextJob), nextTemplate)
+	return
+}
+
+// startPlanned starts the job, if its window is closed the time it opens is returned,
+// the job waiting for the window is not missed when it gets late
+func (j *jobs) startPlanned(job Job, now time.Time) (opens time.Time) {
+	var p Params
+	if err := json.Unmarshal([]byte(job.Params), &p); err != nil {
+		log.WithFields(log.Fields{
+			"id":    job.Id,
+			"error": err.Error(),
+		}).Error("cannt parse params")
+		if err := j.setStatus(job.Id, "error"); err != nil {
+			log.WithFields(log.Fields{
+				"id":    job.Id,
+				"error": err.Error(),
+			}).Error("cannt set error")
+		}
+		return
+	}
+	late := now.Sub(job.RunAt)
+	if !j.scheduler.isDeferred(job.Id) && p.missed(late, time.Duration(j.conf.MissedAfterSeconds)*time.Second) {
+		log.WithFields(log.Fields{
+			"id":     job.Id,
+			"run_at": job.RunAt,
+			"late":   late.String(),
+			"policy": p.Missed,
+		}).Warn("missed")
+		if err := j.setStatus(job.Id, "missed"); err != nil {
+			log.WithFields(log.Fields{
+				"id":    job.Id,
+				"error": err.Error(),
+			}).Error("cannt set missed")
+		}
+		return
+	}
+	_, operator, _ := j.jobOperator(p)
+	if window, err := jobWindow(j.conf.Calendar, operator, p); err == nil && !window.open(now) {
+		opens = window.nextOpen(now)
+		log.WithFields(log.Fields{
+			"id":    job.Id,
+			"opens": opens,
+		}).Debug("window closed")
+		j.scheduler.Lock()
+		j.scheduler.deferred[job.Id] = struct{}{}
+		j.scheduler.Unlock()
+		return
+	}
+
+	if err := j.startJob(job.Id); err != nil {
+		backoff := j.scheduler.failStart(job.Id, now, time.Duration(j.conf.SchedulerMaxBackoffSeconds)*time.Second)
+		log.WithFields(log.Fields{
+			"id":      job.Id,
+			"error":   err.Error(),
+			"backoff": backoff,
+		}).Error("cannt start")
+		return
+	}
+	j.scheduler.Lock()
+	delete(j.scheduler.failed, job.Id)
+	delete(j.scheduler.deferred, job.Id)
+	j.scheduler.Unlock()
+	return
+}
+
+func (s *scheduler) isDeferred(id int64) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.deferred[id]
+	return ok
+}
+
+// missed tells if the job must not be started, late is how late the job is
+func (p Params) missed(late, tolerance time.Duration) bool {
+	if late <= tolerance {
+		return false
+	}
+	switch p.Missed {
+	case missedSkip:
+		return true
+	case missedGrace:
+		return late > time.Duration(p.GraceMinutes)*time.Minute
+	}
+	return false
+}
+
+// keep forgets the deferred and failed starts of the jobs which are not ready and due any more:
+// started, deleted, canceled or planned to later
+func (s *scheduler) keep(due []Job) {
+	ids := make(map[int64]struct{}, len(due))
+	for _, job := range due {
+		ids[job.Id] = struct{}{}
+	}
+	s.Lock()
+	defer s.Unlock()
+	for id := range s.deferred {
+		if _, ok := ids[id]; !ok {
+			delete(s.deferred, id)
+		}
+	}
+	for id := range s.failed {
+		if _, ok := ids[id]; !ok {
+			delete(s.failed, id)
+		}
+	}
+}
+
+func (s *scheduler) retryAt(id int64) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	f, ok := s.failed[id]
+	return f.retryAt, ok
+}
+
+func (s *scheduler) failStart(id int64, now time.Time, maxBackoff time.Duration) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	f := s.failed[id]
+	if f.backoff < minBackoff {
+		f.backoff = minBackoff
+	} else if f.backoff *= 2; f.backoff > maxBackoff {
+		f.backoff = maxBackoff
+	}
+	f.retryAt = now.Add(f.backoff)
+	s.failed[id] = f
+	return f.backoff
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// nextPlanned returns the first run_at of the ready jobs and next_run_at of the templates after now
+func (j *jobs) nextPlanned(now time.Time) (nextJob, nextTemplate time.Time, err error) {
+	var t *time.Time // null if there is nothing
+	query := fmt.Sprintf("SELECT MIN(run_at) FROM %sjobs WHERE status = 'ready' AND run_at >= $1",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query, now).Scan(&t); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	if t != nil {
+		nextJob = *t
+	}
+
+	query = fmt.Sprintf("SELECT MIN(next_run_at) FROM %sjob_templates WHERE status = 'active'",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query).Scan(&t); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	if t != nil {
+		nextTemplate = *t
+	}
+	return
+}
+
+// PlannedRun is the next run of the ready job or the template
+type PlannedRun struct {
+	Kind  string    `json:"kind"` // job or template
+	Id    int64     `json:"id"`
+	Type  string    `json:"type"`
+	RunAt time.Time `json:"run_at"`
+}
+
+// planned?limit=20
+func (j *jobs) plannedRuns(c *gin.Context) {
+	limit := 20
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be from 1 to 1000",
+			})
+			return
+		}
+	}
+
+	runs := []PlannedRun{}
+	jobs, err := j.getList(JobsFilter{Status: "ready"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, job := range jobs {
+		runAt := job.RunAt
+		if retryAt, ok := j.scheduler.retryAt(job.Id); ok && retryAt.After(runAt) {
+			runAt = retryAt
+		}
+		runs = append(runs, PlannedRun{Kind: "job", Id: job.Id, Type: job.Type, RunAt: runAt})
+	}
+
+	templates, err := j.getTemplates(TemplatesFilter{Status: "active"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, t := range templates {
+		schedule, err := cron.Parse(t.Schedule)
+		if err != nil {
+			continue
+		}
+		runAt := t.NextRunAt
+		for i := t.Fired; i < t.Fired+limit && !runAt.IsZero(); i++ {
+			if t.MaxFires > 0 && i >= t.MaxFires {
+				break
+			}
+			runs = append(runs, PlannedRun{Kind: "template", Id: t.Id, Type: t.Type, RunAt: runAt})
+			runAt = schedule.Next(runAt)
+		}
+	}
+
+	sort.SliceStable(runs, func(a, b int) bool {
+		return runs[a].RunAt.Before(runs[b].RunAt)
+	})
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	j.scheduler.Lock()
+	nextWake, backoff := j.scheduler.nextWake, j.scheduler.backoff
+	j.scheduler.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":   j.conf.PlannedEnabled,
+		"next_wake": nextWake,
+		"backoff":   backoff.String(),
+		"runs":      runs,
+	})
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParamsMissed(t *testing.T) {
+	tolerance := time.Minute
+	for _, c := range []struct {
+		p      Params
+		late   time.Duration
+		missed bool
+	}{
+		{Params{}, time.Hour, false},
+		{Params{Missed: missedRunNow}, 24 * time.Hour, false},
+		{Params{Missed: missedSkip}, 30 * time.Second, false},
+		{Params{Missed: missedSkip}, 2 * time.Minute, true},
+		{Params{Missed: missedGrace, GraceMinutes: 10}, 5 * time.Minute, false},
+		{Params{Missed: missedGrace, GraceMinutes: 10}, 11 * time.Minute, true},
+	} {
+		assert.Equal(t, c.missed, c.p.missed(c.late, tolerance), "%+v late %s", c.p, c.late)
+	}
+}
+
+func TestSchedulerFailStartBackoff(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	maxBackoff := 5 * time.Second
+
+	assert.Equal(t, time.Second, s.failStart(1, now, maxBackoff))
+	assert.Equal(t, 2*time.Second, s.failStart(1, now, maxBackoff))
+	assert.Equal(t, 4*time.Second, s.failStart(1, now, maxBackoff))
+	assert.Equal(t, maxBackoff, s.failStart(1, now, maxBackoff))
+
+	retryAt, ok := s.retryAt(1)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(maxBackoff), retryAt)
+	_, ok = s.retryAt(2)
+	assert.False(t, ok)
+}
+
+func TestSchedulerKeep(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	s.failStart(1, now, time.Second)
+	s.failStart(2, now, time.Second)
+	s.deferred[3] = struct{}{}
+	s.deferred[4] = struct{}{}
+
+	s.keep([]Job{{Id: 1}, {Id: 3}})
+	_, ok := s.retryAt(1)
+	assert.True(t, ok)
+	_, ok = s.retryAt(2)
+	assert.False(t, ok, "not ready any more")
+	assert.True(t, s.isDeferred(3))
+	assert.False(t, s.isDeferred(4), "not ready any more")
+}
+
+func TestEarliest(t *testing.T) {
+	a := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	b := a.Add(time.Hour)
+	assert.Equal(t, a, earliest(a, b))
+	assert.Equal(t, a, earliest(b, a))
+	assert.Equal(t, a, earliest(time.Time{}, a))
+	assert.Equal(t, a, earliest(a, time.Time{}))
+	assert.True(t, earliest(time.Time{}, time.Time{}).IsZero())
+}
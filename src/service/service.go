@@ -3,8 +3,11 @@ package service
 // here happens any initialization of new subscriptions
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -22,7 +25,6 @@ type Service struct {
 	dbConn                 *sql.DB
 	suspendedSubscriptions *suspendedSubscriptions
 	jobs                   *jobs
-	exiting                bool
 }
 
 type Config struct {
@@ -43,24 +45,72 @@ func InitService(
 ) {
 	log.SetLevel(log.DebugLevel)
 
-	svc.dbConn = db.Init(dbConf)
-	svc.publisher = amqp.NewNotifier(notifierConfig)
-	svc.suspendedSubscriptions = &suspendedSubscriptions{}
-	svc.jobs = initJobs(jobsConfig, dbSlaveConf)
-
 	svc.conf = Config{
 		server:    serverConfig,
 		db:        dbConf,
 		publisher: notifierConfig,
 	}
+	svc.dbConn = db.Init(dbConf)
+	svc.publisher = amqp.NewNotifier(notifierConfig)
+	svc.suspendedSubscriptions = &suspendedSubscriptions{}
 	initMetrics(appName, metricsConfig)
 
 	if err := mid_client.Init(midConfig); err != nil {
 		log.Fatal("cann't init midory service")
 	}
+
+	svc.jobs = initJobs(jobsConfig, dbSlaveConf)
+	// jobs are resumed here: it needs svc.jobs, db and mid client
+	svc.jobs.recoverJobs()
+	svc.jobs.resumePreviews()
 }
 
-func OnExit() {
+// OnExit stops the running jobs and waits until the notifier has published their charge requests
+// and their statuses and checkpoints are saved,
+// the jobs which haven't stopped before the deadline are saved as they are and the error is returned
+func OnExit(ctx context.Context) error {
 	log.WithField("pid", os.Getpid()).Info("on exit")
-	svc.exiting = true
+	svc.jobs.registry.shutdown(ctx)
+
+	err := svc.jobs.registry.wait(ctx)
+	if err == nil {
+		err = drainPublisher(ctx)
+	}
+	if err != nil {
+		for _, job := range svc.jobs.registry.snapshot() {
+			log.WithFields(log.Fields{
+				"id":    job.Id,
+				"error": err.Error(),
+			}).Error("job hasn't stopped")
+
+			if err := svc.jobs.setProgress(job.checkpoint(), job.Processed, job.Spent, job.LastKey, job.Id); err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("checkpoint")
+			}
+			svc.jobs.flushStats(job)
+			if err := svc.jobs.setStatus(job.Id, "interrupted"); err != nil {
+				log.WithFields(log.Fields{
+					"id":    job.Id,
+					"error": err.Error(),
+				}).Error("set status")
+			}
+		}
+		return err
+	}
+	log.WithField("pid", os.Getpid()).Info("all jobs stopped")
+	return nil
+}
+
+// drainPublisher waits until the notifier has published the messages of its channel
+func drainPublisher(ctx context.Context) error {
+	for svc.publisher.GetQueueSize() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages not published: %s", svc.publisher.GetQueueSize(), ctx.Err().Error())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
 }
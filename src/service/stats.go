@@ -0,0 +1,143 @@
+package service
+
+// per job counters of the actions written in the job log,
+// flushed in job_stats table together with the checkpoint
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	actionSent         = "sent"
+	actionSkip         = "skip" // before job skip
+	actionDuplicate    = "duplicate skip"
+	actionInvalid      = "invalid prefix" // the rejected msisdn has the reason of msisdn.Error as the action
+	actionPaid         = "paid in transactions"
+	actionPublishError = "publish error"
+	actionError        = "error"
+	actionInterrupted  = "interrupted" // not sent, it is charged on resume
+)
+
+// countsProcessed tells if the item counts in processed,
+// the item which wasn't sent because the job stopped is processed again on resume
+func countsProcessed(action string) bool {
+	return action != actionBudget && action != actionInterrupted
+}
+
+// Stats is the count of every action
+type Stats map[string]int64
+
+func (s Stats) copy() Stats {
+	c := make(Stats, len(s))
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+func (r *registry) count(job *Job, action string) {
+	r.Lock()
+	defer r.Unlock()
+	if job.Stats == nil {
+		job.Stats = make(Stats)
+	}
+	job.Stats[action] = job.Stats[action] + 1
+}
+
+// stats returns the copy of the live counters if the job is running
+func (r *registry) stats(id int64) (Stats, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	job, ok := r.running[id]
+	if !ok {
+		return nil, false
+	}
+	return job.Stats.copy(), true
+}
+
+// setStats saves the counters as they are, so it could be called many times
+func (j *jobs) setStats(id int64, stats Stats) (err error) {
+	if len(stats) == 0 {
+		return
+	}
+	args := []interface{}{id, time.Now().UTC()}
+	values := []string{}
+	for action, count := range stats {
+		args = append(args, action, count)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $2)", len(args)-1, len(args)))
+	}
+	query := fmt.Sprintf("INSERT INTO %sjob_stats (id_job, action, count, updated_at) "+
+		" VALUES "+strings.Join(values, ", ")+
+		" ON CONFLICT (id_job, action) DO UPDATE SET "+
+		" count = EXCLUDED.count, updated_at = EXCLUDED.updated_at",
+		svc.conf.db.TablePrefix,
+	)
+	if _, err = svc.dbConn.Exec(query, args...); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+func (j *jobs) getStats(id int64) (stats Stats, err error) {
+	query := fmt.Sprintf("SELECT action, count FROM %sjob_stats WHERE id_job = $1",
+		svc.conf.db.TablePrefix,
+	)
+	var rows *sql.Rows
+	rows, err = svc.dbConn.Query(query, id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	stats = make(Stats)
+	for rows.Next() {
+		var action string
+		var count int64
+		if err = rows.Scan(&action, &count); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		stats[action] = count
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	return
+}
+
+// flushStats is called with checkpoints and on exit, the daily attempts are saved too
+func (j *jobs) flushStats(job Job) {
+	if err := j.setStats(job.Id, job.Stats); err != nil {
+		log.WithFields(log.Fields{
+			"id":    job.Id,
+			"error": err.Error(),
+		}).Error("flush stats")
+	}
+	if err := j.setDaily(job.Id, job.today); err != nil {
+		log.WithFields(log.Fields{
+			"id":    job.Id,
+			"error": err.Error(),
+		}).Error("flush daily")
+	}
+}
+
+// throughput is the items processed per second since the job was started or resumed
+func (j Job) throughput() float64 {
+	elapsed := time.Since(j.startedAt).Seconds()
+	if j.startedAt.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return float64(j.Processed-j.startProcessed) / elapsed
+}
@@ -0,0 +1,395 @@
+package service
+
+// job templates create the same job again and again by the schedule,
+// instead of adding the row for every day like dev/scripts/add_jobs.go does.
+// planned() fires the due templates when they are due, the jobs are created "ready"
+// and started as any other planned job
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/cron"
+)
+
+var errTemplateNotFound = errors.New("Template not found")
+
+// errTemplateChanged means the template was paused, updated or fired by somebody else meanwhile
+var errTemplateChanged = errors.New("Template changed")
+
+// what to do with the runs missed when the service was down
+const (
+	missedRunOnce = "run_once" // one job for all missed runs
+	missedSkip    = "skip"     // no jobs for the missed runs
+	missedRunAll  = "run_all"  // a job for every missed run
+)
+
+type Template struct {
+	Id        int64     `json:"id"`
+	UserId    int64     `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Type      string    `json:"type"`
+	FileName  string    `json:"file_name,omitempty"`
+	Params    string    `json:"params,omitempty"`
+	Schedule  string    `json:"schedule"`
+	Skip      int64     `json:"skip"`                 // skip of the next job
+	SkipStep  int64     `json:"skip_step,omitempty"`  // added to skip on every fire
+	CarrySkip bool      `json:"carry_skip,omitempty"` // the next job continues where the previous one stopped
+	MaxFires  int       `json:"max_fires,omitempty"`  // 0 is unlimited
+	Fired     int       `json:"fired"`
+	Missed    string    `json:"missed"`
+	Status    string    `json:"status"` // active, paused, done
+	NextRunAt time.Time `json:"next_run_at"`
+	LastJobId int64     `json:"last_job_id,omitempty"`
+}
+
+// fireTemplates creates the jobs of the due templates,
+// the error is returned only if templates cannot be selected
+func (j *jobs) fireTemplates(now time.Time) error {
+	templates, err := j.getTemplates(TemplatesFilter{Status: "active", Due: now})
+	if err != nil {
+		return fmt.Errorf("j.getTemplates: %s", err.Error())
+	}
+	for _, t := range templates {
+		if err := j.fireTemplate(t, now); err != nil {
+			log.WithFields(log.Fields{
+				"template": t.Id,
+				"error":    err.Error(),
+			}).Error("cannt fire")
+		}
+	}
+	return nil
+}
+
+func (j *jobs) fireTemplate(t Template, now time.Time) error {
+	schedule, err := cron.Parse(t.Schedule)
+	if err != nil {
+		return fmt.Errorf("cron.Parse: %s", err.Error())
+	}
+
+	var due []time.Time
+	next := t.NextRunAt
+	for !next.IsZero() && !next.After(now) {
+		due = append(due, next)
+		next = schedule.Next(next)
+	}
+	grace := time.Duration(j.conf.MissedAfterSeconds) * time.Second
+
+	for i, runAt := range due {
+		switch t.Missed {
+		case missedSkip:
+			if now.Sub(runAt) > grace {
+				continue
+			}
+		case missedRunAll:
+		default:
+			if i < len(due)-1 {
+				continue
+			}
+		}
+		if t.MaxFires > 0 && t.Fired >= t.MaxFires {
+			break
+		}
+		nextRunAt := next
+		if i+1 < len(due) {
+			nextRunAt = due[i+1]
+		}
+		if err := j.fireJob(&t, runAt, nextRunAt); err != nil {
+			if err == errTemplateChanged {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if t.Status != "active" || !t.NextRunAt.Before(next) && !next.IsZero() {
+		return nil
+	}
+	status := "active"
+	if next.IsZero() {
+		status = "done"
+	}
+	if err := j.advanceTemplate(t, next, status); err != nil && err != errTemplateChanged {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"template":    t.Id,
+		"next_run_at": next,
+		"status":      status,
+		"missed":      len(due),
+	}).Info("advanced")
+	return nil
+}
+
+// fireJob creates the job and moves the template to the next run in one transaction
+func (j *jobs) fireJob(t *Template, runAt, nextRunAt time.Time) (err error) {
+	skip := t.Skip
+	if t.CarrySkip && t.LastJobId > 0 {
+		last, err := j.get(t.LastJobId)
+		if err != nil && err != errJobNotFound {
+			return fmt.Errorf("j.get: %s", err.Error())
+		}
+		// the skip of the job which could be resumed is its checkpoint, not the end
+		if !unfinished(last.Status) && last.Skip > skip {
+			skip = last.Skip
+		}
+	}
+
+	job := Job{
+		UserId:   t.UserId,
+		RunAt:    runAt,
+		Type:     t.Type,
+		Status:   "ready",
+		FileName: t.FileName,
+		Params:   t.Params,
+		Skip:     skip,
+	}
+	fired := t.Fired + 1
+	status := "active"
+	if nextRunAt.IsZero() || (t.MaxFires > 0 && fired >= t.MaxFires) {
+		status = "done"
+	}
+
+	tx, err := svc.dbConn.Begin()
+	if err != nil {
+		DBErrors.Inc()
+		return fmt.Errorf("db.Begin: %s", err.Error())
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	query := fmt.Sprintf("INSERT INTO %sjobs ("+
+		"id_user, "+
+		"run_at, "+
+		"status, "+
+		"type, "+
+		"file_name, "+
+		"params, "+
+		"skip, "+
+		"id_template "+
+		") VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		svc.conf.db.TablePrefix,
+	)
+	if err = tx.QueryRow(query,
+		job.UserId,
+		job.RunAt,
+		job.Status,
+		job.Type,
+		job.FileName,
+		job.Params,
+		job.Skip,
+		t.Id,
+	).Scan(&job.Id); err != nil {
+		DBErrors.Inc()
+		return fmt.Errorf("tx.QueryRow: %s, query: %s", err.Error(), query)
+	}
+
+	query = fmt.Sprintf("UPDATE %sjob_templates SET "+
+		"next_run_at = $1, fired = $2, skip = $3, last_job_id = $4, status = $5 "+
+		" WHERE id = $6 AND next_run_at = $7 AND status = 'active'",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := tx.Exec(query, nextRunAt, fired, skip+t.SkipStep, job.Id, status, t.Id, t.NextRunAt)
+	if err != nil {
+		DBErrors.Inc()
+		return fmt.Errorf("tx.Exec: %s, query: %s", err.Error(), query)
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = errTemplateChanged
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		DBErrors.Inc()
+		return fmt.Errorf("tx.Commit: %s", err.Error())
+	}
+
+	t.NextRunAt = nextRunAt
+	t.Fired = fired
+	t.Skip = skip + t.SkipStep
+	t.LastJobId = job.Id
+	t.Status = status
+	log.WithFields(log.Fields{
+		"template":    t.Id,
+		"id":          job.Id,
+		"run_at":      runAt,
+		"skip":        skip,
+		"fired":       fired,
+		"next_run_at": nextRunAt,
+	}).Info("fired")
+	return nil
+}
+
+// nextRunAt is the first run of the schedule after from
+func nextRunAt(schedule string, from time.Time) (time.Time, error) {
+	s, err := cron.Parse(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := s.Next(from)
+	if next.IsZero() {
+		return next, fmt.Errorf("schedule never runs: %s", schedule)
+	}
+	return next, nil
+}
+
+// TemplatesFilter selects templates for getTemplates, empty fields are not used
+type TemplatesFilter struct {
+	Status string
+	Due    time.Time // next_run_at <= Due
+	Limit  int
+	Offset int
+}
+
+func (f TemplatesFilter) where() (string, []interface{}) {
+	args := []interface{}{}
+	where := ""
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		if where == "" {
+			where = " WHERE "
+		} else {
+			where += " AND "
+		}
+		where += fmt.Sprintf(cond, len(args))
+	}
+	if f.Status != "" {
+		add("status = $%d", f.Status)
+	}
+	if !f.Due.IsZero() {
+		add("next_run_at <= $%d", f.Due)
+	}
+	return where, args
+}
+
+const templateFields = "id, " +
+	"id_user, " +
+	"created_at, " +
+	"type, " +
+	"file_name, " +
+	"params, " +
+	"schedule, " +
+	"skip, " +
+	"skip_step, " +
+	"carry_skip, " +
+	"max_fires, " +
+	"fired, " +
+	"missed, " +
+	"status, " +
+	"next_run_at, " +
+	"last_job_id "
+
+func scanTemplate(rows *sql.Rows) (t Template, err error) {
+	err = rows.Scan(
+		&t.Id,
+		&t.UserId,
+		&t.CreatedAt,
+		&t.Type,
+		&t.FileName,
+		&t.Params,
+		&t.Schedule,
+		&t.Skip,
+		&t.SkipStep,
+		&t.CarrySkip,
+		&t.MaxFires,
+		&t.Fired,
+		&t.Missed,
+		&t.Status,
+		&t.NextRunAt,
+		&t.LastJobId,
+	)
+	return
+}
+
+func (j *jobs) getTemplates(f TemplatesFilter) (templates []Template, err error) {
+	where, args := f.where()
+	limit := ""
+	if f.Limit > 0 {
+		limit = fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, f.Offset)
+	}
+	query := fmt.Sprintf("SELECT "+templateFields+
+		" FROM %sjob_templates "+
+		where+
+		" ORDER BY id ASC"+
+		limit,
+		svc.conf.db.TablePrefix,
+	)
+	var rows *sql.Rows
+	rows, err = svc.dbConn.Query(query, args...)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Template
+		if t, err = scanTemplate(rows); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		templates = append(templates, t)
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	return
+}
+
+func (j *jobs) getTemplate(id int64) (t Template, err error) {
+	query := fmt.Sprintf("SELECT "+templateFields+
+		" FROM %sjob_templates WHERE id = $1 LIMIT 1",
+		svc.conf.db.TablePrefix,
+	)
+	var rows *sql.Rows
+	rows, err = svc.dbConn.Query(query, id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if t, err = scanTemplate(rows); err != nil {
+			DBErrors.Inc()
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+		}
+		return
+	}
+	if err = rows.Err(); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("rows.Err: %s", err.Error())
+		return
+	}
+	err = errTemplateNotFound
+	return
+}
+
+// advanceTemplate moves the template over the runs which don't get jobs
+func (j *jobs) advanceTemplate(t Template, nextRunAt time.Time, status string) (err error) {
+	query := fmt.Sprintf("UPDATE %sjob_templates SET next_run_at = $1, status = $2 "+
+		" WHERE id = $3 AND next_run_at = $4 AND status = 'active'",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := svc.dbConn.Exec(query, nextRunAt, status, t.Id, t.NextRunAt)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errTemplateChanged
+	}
+	return
+}
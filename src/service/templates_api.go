@@ -0,0 +1,384 @@
+package service
+
+// rest api for job templates, the jobs created by the template stay when it is deleted
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// TemplateRequest is the body of POST /templates,
+// start_at is the time the schedule is counted from, now by default
+type TemplateRequest struct {
+	UserId    int64           `json:"user_id"`
+	Type      string          `json:"type"`
+	FileName  string          `json:"file_name,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Schedule  string          `json:"schedule"`
+	StartAt   *time.Time      `json:"start_at,omitempty"`
+	Skip      int64           `json:"skip,omitempty"`
+	SkipStep  int64           `json:"skip_step,omitempty"`
+	CarrySkip bool            `json:"carry_skip,omitempty"`
+	MaxFires  int             `json:"max_fires,omitempty"`
+	Missed    string          `json:"missed,omitempty"`
+}
+
+// TemplatePatch is the body of PATCH /templates/:id, only the given fields are changed
+type TemplatePatch struct {
+	Params    json.RawMessage `json:"params,omitempty"`
+	Schedule  *string         `json:"schedule,omitempty"`
+	StartAt   *time.Time      `json:"start_at,omitempty"`
+	Skip      *int64          `json:"skip,omitempty"`
+	SkipStep  *int64          `json:"skip_step,omitempty"`
+	CarrySkip *bool           `json:"carry_skip,omitempty"`
+	MaxFires  *int            `json:"max_fires,omitempty"`
+	Missed    *string         `json:"missed,omitempty"`
+	Status    *string         `json:"status,omitempty"` // active or paused
+}
+
+func (j *jobs) createTemplate(c *gin.Context) {
+	var req TemplateRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	t := Template{
+		UserId:    req.UserId,
+		Type:      req.Type,
+		FileName:  req.FileName,
+		Params:    "{}",
+		Schedule:  req.Schedule,
+		Skip:      req.Skip,
+		SkipStep:  req.SkipStep,
+		CarrySkip: req.CarrySkip,
+		MaxFires:  req.MaxFires,
+		Missed:    req.Missed,
+		Status:    "active",
+	}
+	if t.Missed == "" {
+		t.Missed = missedRunOnce
+	}
+	if len(req.Params) > 0 {
+		t.Params = string(req.Params)
+	}
+	startAt := time.Now().UTC()
+	if req.StartAt != nil {
+		startAt = req.StartAt.UTC()
+	}
+	if err := t.validate(startAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	id, err := j.insertTemplate(t)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"template":    id,
+		"schedule":    t.Schedule,
+		"next_run_at": t.NextRunAt,
+	}).Info("created")
+	j.wakeScheduler()
+	j.respondTemplate(c, http.StatusCreated, id)
+}
+
+func (j *jobs) readTemplate(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	j.respondTemplate(c, http.StatusOK, id)
+}
+
+// listTemplates?status=active&limit=100&offset=0
+func (j *jobs) listTemplates(c *gin.Context) {
+	f := TemplatesFilter{
+		Status: c.Query("status"),
+		Limit:  100,
+	}
+	var err error
+	if v := c.Query("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be from 1 to 1000",
+			})
+			return
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "offset must be positive",
+			})
+			return
+		}
+	}
+
+	templates, err := j.getTemplates(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if templates == nil {
+		templates = []Template{}
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+func (j *jobs) updateTemplate(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	var req TemplatePatch
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	t, err := j.getTemplate(id)
+	if err != nil {
+		j.respondError(c, err)
+		return
+	}
+	if t.Status == "done" {
+		j.respondError(c, errTemplateChanged)
+		return
+	}
+	prev := t.NextRunAt
+	if len(req.Params) > 0 {
+		t.Params = string(req.Params)
+	}
+	if req.Schedule != nil {
+		t.Schedule = *req.Schedule
+	}
+	if req.Skip != nil {
+		t.Skip = *req.Skip
+	}
+	if req.SkipStep != nil {
+		t.SkipStep = *req.SkipStep
+	}
+	if req.CarrySkip != nil {
+		t.CarrySkip = *req.CarrySkip
+	}
+	if req.MaxFires != nil {
+		t.MaxFires = *req.MaxFires
+	}
+	if req.Missed != nil {
+		t.Missed = *req.Missed
+	}
+	if req.Status != nil {
+		if *req.Status != "active" && *req.Status != "paused" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("status must be active or paused: %s", *req.Status),
+			})
+			return
+		}
+		t.Status = *req.Status
+	}
+	// the next run is counted again only if the schedule is changed
+	startAt := time.Time{}
+	if req.StartAt != nil {
+		startAt = req.StartAt.UTC()
+	} else if req.Schedule != nil {
+		startAt = time.Now().UTC()
+	}
+	if err := t.validate(startAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := j.saveTemplate(t, prev); err != nil {
+		j.respondError(c, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"template":    id,
+		"status":      t.Status,
+		"schedule":    t.Schedule,
+		"next_run_at": t.NextRunAt,
+	}).Info("updated")
+	j.wakeScheduler()
+	j.respondTemplate(c, http.StatusOK, id)
+}
+
+func (j *jobs) removeTemplate(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("strconv.ParseInt: %s", err.Error()),
+		})
+		return
+	}
+	if err := j.deleteTemplate(id); err != nil {
+		j.respondError(c, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"template": id,
+	}).Info("deleted")
+	c.JSON(http.StatusOK, struct{}{})
+}
+
+func (j *jobs) respondTemplate(c *gin.Context, code int, id int64) {
+	t, err := j.getTemplate(id)
+	if err != nil {
+		j.respondError(c, err)
+		return
+	}
+	c.JSON(code, t)
+}
+
+// validate checks the template the same way as the job it creates,
+// the next run is counted from startAt if it is set
+func (t *Template) validate(startAt time.Time) error {
+	if t.Skip < 0 {
+		return fmt.Errorf("skip must be positive: %d", t.Skip)
+	}
+	if t.SkipStep < 0 {
+		return fmt.Errorf("skip_step must be positive: %d", t.SkipStep)
+	}
+	if t.MaxFires < 0 {
+		return fmt.Errorf("max_fires must be positive: %d", t.MaxFires)
+	}
+	switch t.Missed {
+	case missedRunOnce, missedSkip, missedRunAll:
+	default:
+		return fmt.Errorf("missed must be %s, %s or %s: %s", missedRunOnce, missedSkip, missedRunAll, t.Missed)
+	}
+	if !startAt.IsZero() {
+		next, err := nextRunAt(t.Schedule, startAt)
+		if err != nil {
+			return fmt.Errorf("schedule: %s", err.Error())
+		}
+		t.NextRunAt = next
+	}
+
+	job := Job{
+		Type:     t.Type,
+		FileName: t.FileName,
+		Params:   t.Params,
+		Skip:     t.Skip,
+	}
+	return job.validate()
+}
+
+func (j *jobs) insertTemplate(t Template) (id int64, err error) {
+	query := fmt.Sprintf("INSERT INTO %sjob_templates ("+
+		"id_user, "+
+		"type, "+
+		"file_name, "+
+		"params, "+
+		"schedule, "+
+		"skip, "+
+		"skip_step, "+
+		"carry_skip, "+
+		"max_fires, "+
+		"missed, "+
+		"status, "+
+		"next_run_at "+
+		") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id",
+		svc.conf.db.TablePrefix,
+	)
+	if err = svc.dbConn.QueryRow(query,
+		t.UserId,
+		t.Type,
+		t.FileName,
+		t.Params,
+		t.Schedule,
+		t.Skip,
+		t.SkipStep,
+		t.CarrySkip,
+		t.MaxFires,
+		t.Missed,
+		t.Status,
+		t.NextRunAt,
+	).Scan(&id); err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+		return
+	}
+	return
+}
+
+// saveTemplate doesn't touch the template if it has been fired meanwhile
+func (j *jobs) saveTemplate(t Template, prevRunAt time.Time) (err error) {
+	query := fmt.Sprintf("UPDATE %sjob_templates SET "+
+		"params = $1, "+
+		"schedule = $2, "+
+		"skip = $3, "+
+		"skip_step = $4, "+
+		"carry_skip = $5, "+
+		"max_fires = $6, "+
+		"missed = $7, "+
+		"status = $8, "+
+		"next_run_at = $9 "+
+		" WHERE id = $10 AND next_run_at = $11 AND status != 'done'",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := svc.dbConn.Exec(query,
+		t.Params,
+		t.Schedule,
+		t.Skip,
+		t.SkipStep,
+		t.CarrySkip,
+		t.MaxFires,
+		t.Missed,
+		t.Status,
+		t.NextRunAt,
+		t.Id,
+		prevRunAt,
+	)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errTemplateChanged
+	}
+	return
+}
+
+func (j *jobs) deleteTemplate(id int64) (err error) {
+	query := fmt.Sprintf("DELETE FROM %sjob_templates WHERE id = $1",
+		svc.conf.db.TablePrefix,
+	)
+	res, err := svc.dbConn.Exec(query, id)
+	if err != nil {
+		DBErrors.Inc()
+		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errTemplateNotFound
+	}
+	return
+}
@@ -0,0 +1,250 @@
+package service
+
+// the watched folders of injections_path: the file matching the patterns of the folder
+// becomes the "ready" job once it isn't modified for watch.settle_seconds.
+// the sidecar <file>.json is the job request: user_id, run_at, type, skip and params, no other fields,
+// the fields it hasn't are the defaults of the folder, so the sidecar must be dropped before the file.
+// the file is moved to the archive subfolder before the job is created, the job reads it there,
+// the rename is the claim, so several instances don't create the same job.
+// the file which job can't be created is moved to <archive>/failed,
+// the files uploaded by POST /files are not touched
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+const sidecarExt = ".json"
+
+// checkWatch checks the watched folders are inside injections_path and the defaults are json
+func checkWatch(conf config.WatchConfig) error {
+	if conf.Archive == "" || strings.Contains(conf.Archive, "..") || filepath.IsAbs(conf.Archive) {
+		return fmt.Errorf("wrong archive: %s", conf.Archive)
+	}
+	for _, d := range conf.Dirs {
+		if strings.Contains(d.Path, "..") || filepath.IsAbs(d.Path) {
+			return fmt.Errorf("path must be relative to injections_path: %s", d.Path)
+		}
+		for _, pattern := range d.Patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("pattern %s: %s", pattern, err.Error())
+			}
+		}
+		if d.Params != "" && !json.Valid([]byte(d.Params)) {
+			return fmt.Errorf("params of %s: invalid json", d.Path)
+		}
+	}
+	return nil
+}
+
+func (j *jobs) watch() {
+	period := time.Duration(j.conf.Watch.PeriodSeconds) * time.Second
+	if period <= 0 {
+		period = 30 * time.Second
+	}
+	for {
+		for _, d := range j.conf.Watch.Dirs {
+			j.watchDir(d, time.Now())
+		}
+		time.Sleep(period)
+	}
+}
+
+func (j *jobs) watchDir(d config.WatchDir, now time.Time) {
+	dir := filepath.Join(j.conf.InjectionsPath, d.Path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"dir":   dir,
+			"error": err.Error(),
+		}).Error("cannt read watched dir")
+		return
+	}
+	settle := time.Duration(j.conf.Watch.SettleSeconds) * time.Second
+	var uploaded map[string]struct{}
+	for _, fi := range infos {
+		if !watched(d, fi) || now.Sub(fi.ModTime()) < settle {
+			continue
+		}
+		// the sidecar is being written
+		if sfi, err := os.Stat(filepath.Join(dir, fi.Name()+sidecarExt)); err == nil && now.Sub(sfi.ModTime()) < settle {
+			continue
+		}
+		// the files uploaded by POST /files stay where they are
+		if uploaded == nil {
+			if uploaded, err = j.uploadedNames(); err != nil {
+				log.WithFields(log.Fields{
+					"dir":   dir,
+					"error": err.Error(),
+				}).Error("cannt get uploaded files")
+				return
+			}
+		}
+		if _, ok := uploaded[filepath.Join(d.Path, fi.Name())]; ok {
+			continue
+		}
+		j.ingest(d, fi.Name(), now)
+	}
+}
+
+func (j *jobs) uploadedNames() (map[string]struct{}, error) {
+	files, err := j.getFiles("", nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		names[f.FileName] = struct{}{}
+	}
+	return names, nil
+}
+
+// watched tells if the file is the one to create the job from
+func watched(d config.WatchDir, fi os.FileInfo) bool {
+	name := fi.Name()
+	if !fi.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(strings.ToLower(name), sidecarExt) {
+		return false
+	}
+	if len(d.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range d.Patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchRequest is the sidecar of the file over the defaults of the folder
+func watchRequest(d config.WatchDir, sidecar string, now time.Time) (req JobRequest, err error) {
+	req = JobRequest{
+		UserId: d.UserId,
+		Type:   d.Type,
+	}
+	if req.Type == "" {
+		req.Type = "injection"
+	}
+	if d.Params != "" {
+		req.Params = json.RawMessage(d.Params)
+	}
+	data, err := ioutil.ReadFile(sidecar)
+	if err != nil && !os.IsNotExist(err) {
+		return req, fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+	}
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&req); err != nil {
+			return req, fmt.Errorf("sidecar: %s", err.Error())
+		}
+	}
+	if req.RunAt == nil {
+		runAt := now.Add(time.Duration(d.RunAfterMinutes) * time.Minute).UTC()
+		req.RunAt = &runAt
+	}
+	return req, nil
+}
+
+// claimFile moves the file and its sidecar to the archive, false if another instance has done it,
+// the file with the name already archived gets the time prefix
+func (j *jobs) claimFile(d config.WatchDir, name string, now time.Time) (archived string, ok bool, err error) {
+	dir := filepath.Join(j.conf.InjectionsPath, d.Path)
+	archive := filepath.Join(dir, j.conf.Watch.Archive)
+	if err = os.MkdirAll(archive, 0755); err != nil {
+		return "", false, fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	archived = name
+	if _, err := os.Stat(filepath.Join(archive, archived)); err == nil {
+		archived = now.Format("20060102150405") + "_" + name
+	}
+	if err = os.Rename(filepath.Join(dir, name), filepath.Join(archive, archived)); err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	err = os.Rename(filepath.Join(dir, name+sidecarExt), filepath.Join(archive, archived+sidecarExt))
+	if err != nil && !os.IsNotExist(err) {
+		return archived, true, fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return archived, true, nil
+}
+
+// ingest creates the job from the file
+func (j *jobs) ingest(d config.WatchDir, name string, now time.Time) {
+	logCtx := log.WithFields(log.Fields{
+		"dir":  d.Path,
+		"file": name,
+	})
+	archived, ok, err := j.claimFile(d, name, now)
+	if !ok {
+		if err != nil {
+			logCtx.WithField("error", err.Error()).Error("cannt archive")
+		}
+		return
+	}
+	archive := filepath.Join(d.Path, j.conf.Watch.Archive)
+	if err == nil {
+		err = j.createWatched(d, archive, archived, now)
+	}
+	if err != nil {
+		logCtx.WithField("error", err.Error()).Error("cannt create job")
+		j.failFile(archive, archived)
+	}
+}
+
+func (j *jobs) createWatched(d config.WatchDir, archive, archived string, now time.Time) error {
+	req, err := watchRequest(d, filepath.Join(j.conf.InjectionsPath, archive, archived+sidecarExt), now)
+	if err != nil {
+		return err
+	}
+	req.FileName = filepath.Join(archive, archived)
+	job, err := newJob(req)
+	if err != nil {
+		return err
+	}
+	id, err := j.insert(job)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":     id,
+		"type":   job.Type,
+		"run_at": job.RunAt,
+		"file":   job.FileName,
+	}).Info("created")
+	j.wakeScheduler()
+	return nil
+}
+
+// failFile moves the archived file and its sidecar to <archive>/failed
+func (j *jobs) failFile(archive, archived string) {
+	from := filepath.Join(j.conf.InjectionsPath, archive)
+	to := filepath.Join(from, "failed")
+	if err := os.MkdirAll(to, 0755); err != nil {
+		log.WithFields(log.Fields{
+			"dir":   to,
+			"error": err.Error(),
+		}).Error("cannt create failed dir")
+		return
+	}
+	for _, name := range []string{archived, archived + sidecarExt} {
+		if err := os.Rename(filepath.Join(from, name), filepath.Join(to, name)); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"file":  name,
+				"error": err.Error(),
+			}).Error("cannt move to failed")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := config.WatchConfig{Archive: "archive", Dirs: []config.WatchDir{{
+		Path:            "drop",
+		Patterns:        []string{"*.csv", "*.txt"},
+		UserId:          7,
+		Params:          `{"service_code": "111"}`,
+		RunAfterMinutes: 10,
+	}}}
+	assert.NoError(t, checkWatch(conf))
+	assert.Error(t, checkWatch(config.WatchConfig{Archive: "archive", Dirs: []config.WatchDir{{Path: "../etc"}}}))
+	assert.Error(t, checkWatch(config.WatchConfig{Archive: "archive", Dirs: []config.WatchDir{{Params: "{"}}}))
+	d := conf.Dirs[0]
+
+	drop := filepath.Join(dir, "drop")
+	assert.NoError(t, os.MkdirAll(drop, 0755))
+	for name, data := range map[string]string{
+		"a.csv":      "923001112233\n",
+		"a.csv.json": `{"run_at": "2017-09-01T10:00:00Z", "params": {"service_code": "222"}}`,
+		"b.txt":      "923001112233\n",
+		"c.xls":      "",
+		".upload-1":  "",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(drop, name), []byte(data), 0644))
+	}
+	for name, ok := range map[string]bool{"a.csv": true, "a.csv.json": false, "b.txt": true, "c.xls": false, ".upload-1": false} {
+		fi, err := os.Stat(filepath.Join(drop, name))
+		assert.NoError(t, err)
+		assert.Equal(t, ok, watched(d, fi), name)
+	}
+
+	now := time.Date(2017, 8, 20, 12, 0, 0, 0, time.UTC)
+	req, err := watchRequest(d, filepath.Join(drop, "b.txt.json"), now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), req.UserId)
+	assert.Equal(t, "injection", req.Type)
+	assert.Equal(t, `{"service_code": "111"}`, string(req.Params), "defaults of the dir")
+	assert.Equal(t, now.Add(10*time.Minute), *req.RunAt)
+
+	req, err = watchRequest(d, filepath.Join(drop, "a.csv.json"), now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), req.UserId)
+	assert.Equal(t, `{"service_code": "222"}`, string(req.Params), "sidecar")
+	assert.Equal(t, time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC), *req.RunAt)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(drop, "b.txt.json"), []byte(`{"runat": "2017-09-01T10:00:00Z"}`), 0644))
+	_, err = watchRequest(d, filepath.Join(drop, "b.txt.json"), now)
+	assert.Error(t, err, "unknown field")
+	assert.NoError(t, os.Remove(filepath.Join(drop, "b.txt.json")))
+
+	j := &jobs{conf: config.JobsConfig{InjectionsPath: dir, Watch: conf}}
+	archived, ok, err := j.claimFile(d, "a.csv", now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "a.csv", archived)
+	_, err = os.Stat(filepath.Join(drop, "archive", "a.csv.json"))
+	assert.NoError(t, err, "sidecar archived")
+
+	_, ok, err = j.claimFile(d, "a.csv", now)
+	assert.NoError(t, err)
+	assert.False(t, ok, "claimed already")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(drop, "a.csv"), []byte("923001112233\n"), 0644))
+	archived, ok, err = j.claimFile(d, "a.csv", now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "20170820120000_a.csv", archived, "the same name is archived already")
+
+	j.failFile(filepath.Join("drop", "archive"), "a.csv")
+	_, err = os.Stat(filepath.Join(drop, "archive", "failed", "a.csv"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(drop, "archive", "failed", "a.csv.json"))
+	assert.NoError(t, err)
+}
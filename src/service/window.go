@@ -0,0 +1,194 @@
+package service
+
+// send windows: the msisdns are charged only inside the allowed hours
+// in the operator timezone and never on the blackout dates.
+// the windows and the blackouts are taken from the params of the job or from jobs.calendar,
+// the blackouts of both are used, the timezone is of the operator of the job if it has one
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+const statusWaiting = "waiting for window"
+
+// span is the window in minutes from midnight, from < to, or it is overnight like 22:00-02:00
+type span struct {
+	from, to int
+}
+
+type sendWindow struct {
+	loc       *time.Location
+	spans     []span
+	blackouts map[string]struct{} // 2006-01-02
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("wrong time %s, expected 15:04", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// newSendWindow parses windows "09:00-21:00" and blackouts "2017-08-14",
+// no windows means the whole day
+func newSendWindow(timezone string, windows, blackouts []string) (*sendWindow, error) {
+	w := &sendWindow{
+		loc:       time.UTC,
+		blackouts: make(map[string]struct{}),
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("time.LoadLocation: %s", err.Error())
+		}
+		w.loc = loc
+	}
+	for _, window := range windows {
+		bounds := strings.Split(window, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("wrong window %s, expected 09:00-21:00", window)
+		}
+		from, err := parseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if from == to {
+			return nil, fmt.Errorf("empty window: %s", window)
+		}
+		w.spans = append(w.spans, span{from: from, to: to})
+	}
+	for _, date := range blackouts {
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(date))
+		if err != nil {
+			return nil, fmt.Errorf("wrong blackout date %s, expected 2006-01-02", date)
+		}
+		w.blackouts[d.Format("2006-01-02")] = struct{}{}
+	}
+	return w, nil
+}
+
+func (w *sendWindow) blackout(t time.Time) bool {
+	_, ok := w.blackouts[t.Format("2006-01-02")]
+	return ok
+}
+
+// open tells if the message could be sent at t
+func (w *sendWindow) open(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.blackout(t) {
+		return false
+	}
+	if len(w.spans) == 0 {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, s := range w.spans {
+		if s.from < s.to && m >= s.from && m < s.to {
+			return true
+		}
+		if s.from > s.to && (m >= s.from || m < s.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen is the first minute from t when the window is open,
+// zero time if it is closed for the next year
+func (w *sendWindow) nextOpen(t time.Time) time.Time {
+	if w.open(t) {
+		return t
+	}
+	t = t.In(w.loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.loc)
+	for i := 0; i <= 366; i++ {
+		if w.blackout(day) {
+			day = day.AddDate(0, 0, 1)
+			continue
+		}
+		starts := []int{0}
+		for _, s := range w.spans {
+			starts = append(starts, s.from)
+		}
+		var first time.Time
+		for _, m := range starts {
+			at := day.Add(time.Duration(m) * time.Minute)
+			if at.Before(t) || !w.open(at) {
+				continue
+			}
+			if first.IsZero() || at.Before(first) {
+				first = at
+			}
+		}
+		if !first.IsZero() {
+			return first.UTC()
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// window of the job: timezone and windows from params override the calendar,
+// the timezone of the operator of the job overrides the calendar timezone
+func jobWindow(c config.CalendarConfig, o config.OperatorConfig, p Params) (*sendWindow, error) {
+	timezone := c.Timezone
+	if o.Timezone != "" {
+		timezone = o.Timezone
+	}
+	if p.Timezone != "" {
+		timezone = p.Timezone
+	}
+	windows := c.Windows
+	if len(p.Windows) > 0 {
+		windows = p.Windows
+	}
+	return newSendWindow(timezone, windows, append(append([]string{}, c.Blackouts...), p.Blackouts...))
+}
+
+// waitWindow blocks the job goroutine while the window is closed,
+// it returns earlier if the job is asked to stop
+func (j *Job) waitWindow() {
+	if j.window == nil || j.window.open(time.Now()) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":        j.Id,
+		"next_open": j.window.nextOpen(time.Now()),
+	}).Info("waiting for window")
+	j.setRunningStatus(statusWaiting)
+	for !j.window.open(time.Now()) {
+		if requested, _ := svc.jobs.registry.stopRequested(j); requested {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	j.windowOpenedAt = time.Now()
+	log.WithFields(log.Fields{
+		"id": j.Id,
+	}).Info("window opened")
+	j.setRunningStatus("in progress")
+}
+
+func (j *Job) setRunningStatus(status string) {
+	if !svc.jobs.registry.setStatus(j, status) {
+		return
+	}
+	if err := svc.jobs.setStatus(j.Id, status); err != nil {
+		log.WithFields(log.Fields{
+			"id":     j.Id,
+			"status": status,
+			"error":  err.Error(),
+		}).Error("cannt set status")
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-jobs/src/config"
+)
+
+func TestSendWindowErrors(t *testing.T) {
+	for _, c := range []struct {
+		timezone           string
+		windows, blackouts []string
+	}{
+		{"Nowhere/City", nil, nil},
+		{"", []string{"09:00"}, nil},
+		{"", []string{"9-21"}, nil},
+		{"", []string{"09:00-09:00"}, nil},
+		{"", nil, []string{"14.08.2017"}},
+	} {
+		_, err := newSendWindow(c.timezone, c.windows, c.blackouts)
+		assert.Error(t, err, "%+v", c)
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	w, err := newSendWindow("Asia/Karachi", []string{"09:00-12:00", "22:00-01:00"}, []string{"2017-08-14"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	pkt := func(day, hour, minute int) time.Time {
+		return time.Date(2017, 8, day, hour, minute, 0, 0, w.loc)
+	}
+
+	assert.True(t, w.open(pkt(10, 9, 0)), "window start")
+	assert.False(t, w.open(pkt(10, 12, 0)), "window end")
+	assert.True(t, w.open(pkt(10, 23, 30)), "overnight")
+	assert.True(t, w.open(pkt(11, 0, 30)), "overnight after midnight")
+	assert.False(t, w.open(pkt(14, 10, 0)), "blackout")
+	assert.True(t, w.open(pkt(10, 4, 0).In(time.UTC).Add(5*time.Hour)), "utc is converted")
+
+	assert.Equal(t, pkt(10, 9, 0), w.nextOpen(pkt(10, 3, 0)).In(w.loc), "today")
+	assert.Equal(t, pkt(10, 22, 0), w.nextOpen(pkt(10, 12, 0)).In(w.loc), "second window")
+	assert.Equal(t, pkt(15, 0, 0), w.nextOpen(pkt(13, 23, 59).Add(2*time.Minute)).In(w.loc), "after blackout")
+	now := pkt(10, 10, 0)
+	assert.Equal(t, now, w.nextOpen(now), "already open")
+}
+
+func TestJobWindow(t *testing.T) {
+	c := config.CalendarConfig{
+		Timezone:  "UTC",
+		Windows:   []string{"09:00-21:00"},
+		Blackouts: []string{"2017-08-14"},
+	}
+	w, err := jobWindow(c, config.OperatorConfig{}, Params{Windows: []string{"10:00-11:00"}, Blackouts: []string{"2017-08-15"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, w.open(time.Date(2017, 8, 10, 9, 30, 0, 0, time.UTC)), "params windows override")
+	assert.False(t, w.open(time.Date(2017, 8, 14, 10, 30, 0, 0, time.UTC)), "calendar blackout")
+	assert.False(t, w.open(time.Date(2017, 8, 15, 10, 30, 0, 0, time.UTC)), "params blackout")
+	assert.True(t, w.open(time.Date(2017, 8, 16, 10, 30, 0, 0, time.UTC)), "open")
+}
+
+func TestJobWindowOperator(t *testing.T) {
+	c := config.CalendarConfig{Timezone: "Asia/Karachi", Windows: []string{"09:00-21:00"}}
+	w, err := jobWindow(c, config.OperatorConfig{Timezone: "Europe/Moscow"}, Params{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Europe/Moscow", w.loc.String(), "operator timezone")
+	assert.True(t, w.open(time.Date(2017, 8, 10, 17, 30, 0, 0, time.UTC)), "20:30 in Moscow")
+
+	w, err = jobWindow(c, config.OperatorConfig{Timezone: "Europe/Moscow"}, Params{Timezone: "UTC"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "UTC", w.loc.String(), "params override")
+	}
+}
@@ -1,7 +1,10 @@
 package src
 
 import (
+	"context"
+	"net/http"
 	"runtime"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -11,8 +14,12 @@ import (
 	m "github.com/linkit360/go-utils/metrics"
 )
 
+var server *http.Server
+var shutdownTimeout time.Duration
+
 func RunServer() {
 	appConfig := config.LoadConfig()
+	shutdownTimeout = time.Duration(appConfig.Server.ShutdownTimeoutSeconds) * time.Second
 
 	service.InitService(
 		appConfig.AppName,
@@ -33,10 +40,27 @@ func RunServer() {
 	m.AddHandler(r)
 	service.AddSubscriptionsHandler(r)
 	service.AddJobHandlers(r)
-	r.Run(appConfig.Server.Host + ":" + appConfig.Server.Port)
-	log.WithField("dsn", appConfig.Server.Host+":"+appConfig.Server.Port).Info("init")
+
+	server = &http.Server{
+		Addr:    appConfig.Server.Host + ":" + appConfig.Server.Port,
+		Handler: r,
+	}
+	log.WithField("dsn", server.Addr).Info("init")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithField("error", err.Error()).Fatal("server")
+	}
 }
 
-func OnExit() {
-	service.OnExit()
+// OnExit stops accepting requests, then stops the jobs,
+// everything must be done before the shutdown timeout, otherwise the error is returned
+func OnExit() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithField("error", err.Error()).Error("server shutdown")
+		}
+	}
+	return service.OnExit(ctx)
 }